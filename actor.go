@@ -0,0 +1,59 @@
+package flowchart
+
+import (
+	"context"
+	"fmt"
+)
+
+// Actor is whoever is taking an action. TakeAction and TakeActionContext act as the zero Actor,
+// who has no roles.
+type Actor struct {
+	ID    string
+	Roles []string
+}
+
+func (a Actor) HasRole(role string) bool {
+	return contains(a.Roles, role)
+}
+
+// Authorizer decides whether an actor may take an action from a stage, for rules that Transition.Roles
+// can't express. Any error it returns denies the action.
+type Authorizer interface {
+	Authorize(ctx context.Context, actor Actor, action string, origin string) error
+}
+
+// AuthorizerFunc lets a plain function be used as an Authorizer
+type AuthorizerFunc func(ctx context.Context, actor Actor, action string, origin string) error
+
+func (fn AuthorizerFunc) Authorize(ctx context.Context, actor Actor, action string, origin string) error {
+	return fn(ctx, actor, action, origin)
+}
+
+// SetAuthorizer adds a check that runs for every action, after the transition's own Roles; pass nil to remove it.
+// Like hooks, it applies to every copy of the flow.
+func (f *Flow[Asset]) SetAuthorizer(authorizer Authorizer) {
+	f.configure(func(settings *flowSettings) { settings.authorizer = authorizer })
+}
+
+// authorize checks the transition's roles and then the flow's Authorizer. Errors match ErrPermissionDenied.
+func (f Flow[Asset]) authorize(ctx context.Context, actor Actor, tran Transition, origin string) error {
+	if len(tran.Roles) > 0 {
+		allowed := false
+		for _, role := range tran.Roles {
+			if actor.HasRole(role) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return causeError{ErrPermissionDenied, fmt.Errorf("actor '%s' needs one of the roles %v", actor.ID, tran.Roles)}
+		}
+	}
+
+	if authorizer := f.settings().authorizer; authorizer != nil {
+		if err := authorizer.Authorize(ctx, actor, tran.Name, origin); err != nil {
+			return causeError{ErrPermissionDenied, err}
+		}
+	}
+	return nil
+}
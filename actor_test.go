@@ -0,0 +1,87 @@
+package flowchart
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSafeTakeActionAs(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	age := unfinished.Transitions[actionAge]
+	age.Roles = []string{"gardener", "entomologist"}
+	unfinished.Transitions[actionAge] = age
+	flow := unfinished.Finish()
+
+	store := NewMemoryHistory()
+	flow.SetHistoryStore(store)
+	var seen []Actor
+	flow.AfterTransition(func(event TransitionEvent[*Butterfly]) {
+		seen = append(seen, event.Actor)
+	})
+
+	ctx := context.Background()
+	Paula := Butterfly{color: "green", lifeStage: stageEgg}
+
+	// nobody in particular can't age her
+	if _, err := flow.TakeAction(&Paula, actionAge); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected %v for an anonymous actor, got %v", ErrPermissionDenied, err)
+	}
+	visitor := Actor{ID: "vic", Roles: []string{"visitor"}}
+	_, err := flow.TakeActionAs(ctx, visitor, &Paula, actionAge)
+	transErr := &TransitionError{}
+	if !errors.As(err, &transErr) || !errors.Is(err, ErrPermissionDenied) || transErr.Status != stageEgg {
+		t.Errorf("expected a TransitionError matching %v from %s, got %v", ErrPermissionDenied, stageEgg, err)
+	}
+	if Paula.lifeStage != stageEgg {
+		t.Errorf("a denied action shouldn't move the asset, she's now %s", Paula.lifeStage)
+	}
+
+	gardener := Actor{ID: "gail", Roles: []string{"visitor", "gardener"}}
+	change, err := flow.TakeActionAs(ctx, gardener, &Paula, actionAge)
+	if err != nil || change != stageCaterpillar {
+		t.Errorf("expected the gardener to move her to %s, got %s, %v", stageCaterpillar, change, err)
+	}
+	if len(seen) != 1 || seen[0].ID != "gail" {
+		t.Errorf("expected hooks to see the gardener, got %v", seen)
+	}
+
+	entries, _ := flow.History(ctx, &Paula)
+	if len(entries) != 3 || entries[1].Actor.ID != "vic" || entries[2].Actor.ID != "gail" {
+		t.Errorf("expected the actors recorded in history, got %+v", entries)
+	}
+
+	available, blocked, err := flow.AvailableActionsAs(visitor, &Paula)
+	if err != nil || len(available) != 0 || len(blocked) == 0 || !errors.Is(blocked[0].Blocked, ErrPermissionDenied) {
+		t.Errorf("expected the visitor to be blocked, got %v, %v, %v", available, blocked, err)
+	}
+}
+
+func TestSafeAuthorizer(t *testing.T) {
+	flow := generateSimpleFlow()
+	suspended := errors.New("account suspended")
+	flow.SetAuthorizer(AuthorizerFunc(func(_ context.Context, actor Actor, action, origin string) error {
+		if actor.ID == "mallory" {
+			return suspended
+		}
+		return nil
+	}))
+
+	ctx := context.Background()
+	Quentin := Butterfly{color: "green", lifeStage: stageEgg}
+	_, err := flow.TakeActionAs(ctx, Actor{ID: "mallory"}, &Quentin, actionAge)
+	if !errors.Is(err, ErrPermissionDenied) || !errors.Is(err, suspended) {
+		t.Errorf("expected %v caused by %v, got %v", ErrPermissionDenied, suspended, err)
+	}
+
+	// permission comes before the context is looked at, so a bad action is still reported as such
+	_, err = flow.TakeActionAs(ctx, Actor{ID: "mallory"}, &Butterfly{color: "green", lifeStage: stageCocoon}, actionSeen)
+	if !errors.Is(err, ErrActionNotAllowed) {
+		t.Errorf("expected %v ahead of the authorizer, got %v", ErrActionNotAllowed, err)
+	}
+
+	change, err := flow.TakeActionAs(ctx, Actor{ID: "alice"}, &Quentin, actionAge)
+	if err != nil || change != stageCaterpillar {
+		t.Errorf("expected alice to move him to %s, got %s, %v", stageCaterpillar, change, err)
+	}
+}
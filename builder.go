@@ -0,0 +1,191 @@
+package flowchart
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Builder puts a flow together one branch at a time, creating stages and transitions as they're
+// mentioned and saving every mistake for Build:
+//
+//	b := NewBuilder[*Butterfly]()
+//	b.Stage("egg", Initial())
+//	b.From("egg").On("hatch").GoTo("caterpillar")
+//	b.From("cocoon").On("emerge").When("isBrown", true).GoTo("moth")
+//	b.From("cocoon").On("emerge").When("isBrown", false).GoTo("butterfly")
+//	flow, err := b.Build()
+type Builder[Asset Flowable] struct {
+	stages          map[string]*Stage
+	stageOrder      []string
+	transitions     map[string]*Transition
+	transitionOrder []string
+	errs            []error
+}
+
+func NewBuilder[Asset Flowable]() *Builder[Asset] {
+	return &Builder[Asset]{
+		stages:      map[string]*Stage{},
+		transitions: map[string]*Transition{},
+	}
+}
+
+// Stage declares a stage up front, usually to give it options. Stages only mentioned in From and
+// GoTo are created with no options.
+func (b *Builder[Asset]) Stage(name string, options ...StageOption) *Builder[Asset] {
+	stage := b.stage(name)
+	if stage != nil {
+		for _, option := range options {
+			option(stage)
+		}
+	}
+	return b
+}
+
+// Transition gives access to a transition for settings the builder doesn't cover, like Roles or Delay
+func (b *Builder[Asset]) Transition(action string, configure func(*Transition)) *Builder[Asset] {
+	if tran := b.transition(action); tran != nil {
+		configure(tran)
+	}
+	return b
+}
+
+// From starts a branch leaving the stage
+func (b *Builder[Asset]) From(stage string) *FromBuilder[Asset] {
+	return &FromBuilder[Asset]{builder: b, from: stage}
+}
+
+// FromBuilder is a branch that knows where it starts but not which action takes it
+type FromBuilder[Asset Flowable] struct {
+	builder *Builder[Asset]
+	from    string
+}
+
+// On names the action the branch belongs to
+func (fb *FromBuilder[Asset]) On(action string) *BranchBuilder[Asset] {
+	table := ValidationTableFrom(nil)
+	return &BranchBuilder[Asset]{builder: fb.builder, from: fb.from, action: action, table: table}
+}
+
+// BranchBuilder collects the conditions of a branch until GoTo adds it
+type BranchBuilder[Asset Flowable] struct {
+	builder  *Builder[Asset]
+	from     string
+	action   string
+	table    ValidationTable
+	guard    Guard
+	priority int
+}
+
+// When requires the context's tag to be flag
+func (bb *BranchBuilder[Asset]) When(tag string, flag bool) *BranchBuilder[Asset] {
+	bb.table.AddFlag(tag, flag)
+	return bb
+}
+
+// If requires the guard to pass as well; calling it again requires both. A guard with an Err is
+// reported by Build.
+func (bb *BranchBuilder[Asset]) If(guard Guard) *BranchBuilder[Asset] {
+	if err := guard.Err(); err != nil {
+		bb.builder.errs = append(bb.builder.errs, fmt.Errorf("branch of '%s' from '%s': %w", bb.action, bb.from, err))
+	}
+	if bb.guard.IsZero() {
+		bb.guard = guard
+	} else {
+		bb.guard = AllOf(bb.guard, guard)
+	}
+	return bb
+}
+
+// Priority moves the branch ahead of (or behind) the others; see Transition.SetPriority
+func (bb *BranchBuilder[Asset]) Priority(priority int) *BranchBuilder[Asset] {
+	bb.priority = priority
+	return bb
+}
+
+// GoTo adds the branch, leading to destination, and hands back the builder for the next one
+func (bb *BranchBuilder[Asset]) GoTo(destination string) *Builder[Asset] {
+	b := bb.builder
+	origin, target, tran := b.stage(bb.from), b.stage(destination), b.transition(bb.action)
+	if origin == nil || target == nil || tran == nil {
+		return b
+	}
+
+	condition := tableAndGuard{bb.table, bb.guard}
+	if _, exists := tran.NextStages[branchKey(bb.from, condition)]; exists {
+		b.errs = append(b.errs, fmt.Errorf("branch of '%s' from '%s' for %s was added twice", bb.action, bb.from, bb.table.String()))
+		return b
+	}
+	if !contains(origin.Transitions, bb.action) {
+		origin.addTransition(bb.action)
+	}
+	key := tran.addBranch(bb.from, condition, destination)
+	if bb.priority != 0 {
+		if tran.Priorities == nil {
+			tran.Priorities = map[ValidationString]int{}
+		}
+		tran.Priorities[key] = bb.priority
+	}
+	return b
+}
+
+// Unfinished hands over everything built so far, or every mistake made along the way
+func (b *Builder[Asset]) Unfinished() (UnfinishedFlow[Asset], error) {
+	flow := NewFlow[Asset]()
+	if len(b.errs) > 0 {
+		return flow, builderErrors(b.errs)
+	}
+	for _, name := range b.stageOrder {
+		flow.AddStages(*b.stages[name])
+	}
+	for _, name := range b.transitionOrder {
+		flow.AddTransitions(*b.transitions[name])
+	}
+	return flow, nil
+}
+
+// Build finishes the flow, validated like FinishValidated
+func (b *Builder[Asset]) Build(start ...string) (Flow[Asset], error) {
+	unfinished, err := b.Unfinished()
+	if err != nil {
+		return Flow[Asset]{}, err
+	}
+	return unfinished.FinishValidated(start...)
+}
+
+func (b *Builder[Asset]) stage(name string) *Stage {
+	if name == "" {
+		b.errs = append(b.errs, errors.New("stage names can't be empty"))
+		return nil
+	}
+	if _, OK := b.stages[name]; !OK {
+		stage := NewStage(name)
+		b.stages[name] = &stage
+		b.stageOrder = append(b.stageOrder, name)
+	}
+	return b.stages[name]
+}
+
+func (b *Builder[Asset]) transition(action string) *Transition {
+	if action == "" {
+		b.errs = append(b.errs, errors.New("action names can't be empty"))
+		return nil
+	}
+	if _, OK := b.transitions[action]; !OK {
+		tran := NewTransition(action)
+		b.transitions[action] = &tran
+		b.transitionOrder = append(b.transitionOrder, action)
+	}
+	return b.transitions[action]
+}
+
+// builderErrors is every mistake a Builder saw, in the order it saw them
+type builderErrors []error
+
+func (errs builderErrors) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("flow builder has %d problem(s): %s", len(errs), strings.Join(messages, "; "))
+}
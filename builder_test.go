@@ -0,0 +1,127 @@
+package flowchart
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// buildGranularFlowFluently is buildGranularFlow written with a Builder
+func buildGranularFlowFluently() *Builder[*Butterfly] {
+	b := NewBuilder[*Butterfly]()
+	b.From(stageEgg).On(actionHatch).GoTo(stageCaterpillar)
+	b.From(stageCaterpillar).On(actionGrow).GoTo(stageCocoon)
+	b.From(stageCocoon).On(actionEmerge).When("isBrown", false).GoTo(stageButterfly)
+	b.From(stageCocoon).On(actionEmerge).When("isBrown", true).GoTo(stageMoth)
+	for _, stage := range []string{stageEgg, stageCaterpillar, stageButterfly, stageMoth} {
+		b.From(stage).On(actionSeen).When("isGreen", false).GoTo(stageEaten)
+	}
+	return b
+}
+
+func TestSafeBuilder(t *testing.T) {
+	built, err := buildGranularFlowFluently().Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byHand := buildGranularFlow()
+	byHand.AddStages(NewStage(stageEaten))
+
+	builtJSON, _ := json.Marshal(built)
+	byHandJSON, _ := json.Marshal(byHand)
+	if string(builtJSON) != string(byHandJSON) {
+		t.Errorf("expected the same flow as by hand\nbuilt:   %s\nby hand: %s", builtJSON, byHandJSON)
+	}
+
+	b := buildGranularFlowFluently()
+	b.Stage(stageEgg, Initial()).Stage(stageEaten, Terminal())
+	b.Transition(actionSeen, func(tran *Transition) { tran.Roles = []string{"bird"} })
+	flow, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runButterflyTests(&Butterfly{color: "green", lifeStage: stageEgg}, []butterflyTest{
+		{action: actionHatch, result: stageCaterpillar},
+		{action: actionGrow, result: stageCocoon},
+		{action: actionEmerge, result: stageButterfly},
+	}, func() Flow[*Butterfly] { return flow }, t)
+	if _, err := flow.TakeAction(&Butterfly{color: "red", lifeStage: stageEgg}, actionSeen); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected the transition's roles to apply, got %v", err)
+	}
+}
+
+func TestSafeBuilderGuardsAndPriorities(t *testing.T) {
+	b := NewBuilder[*Butterfly]()
+	// old brown cocoons match the first two branches, and the priority puts the moth first
+	b.From(stageCocoon).On(actionAge).If(Compare("cocoonAge", ">=", 3)).GoTo(stageButterfly)
+	b.From(stageCocoon).On(actionAge).If(Compare("cocoonAge", ">=", 3)).When("isBrown", true).Priority(1).GoTo(stageMoth)
+	// anything else falls through to the catch-all, declared last
+	b.From(stageCocoon).On(actionAge).GoTo(stageCocoon)
+	flow, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bug  Butterfly
+		want string
+	}{
+		{Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 3}, stageMoth},
+		{Butterfly{color: "green", lifeStage: stageCocoon, cocoonAge: 3}, stageButterfly},
+		{Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 1}, stageCocoon},
+	}
+	for _, test := range tests {
+		bug := test.bug
+		if change, err := flow.TakeAction(&bug, actionAge); err != nil || change != test.want {
+			t.Errorf("expected %+v to go to %s, got %s, %v", test.bug, test.want, change, err)
+		}
+	}
+}
+
+func TestSafeBuilderErrors(t *testing.T) {
+	b := NewBuilder[*Butterfly]()
+	b.From("").On(actionHatch).GoTo(stageCaterpillar)
+	b.From(stageEgg).On("").GoTo(stageCaterpillar)
+	b.From(stageEgg).On(actionHatch).GoTo(stageCaterpillar)
+	b.From(stageEgg).On(actionHatch).GoTo(stageMoth)
+	b.From(stageCocoon).On(actionAge).If(Compare("cocoonAge", "=>", 3)).GoTo(stageButterfly)
+	if _, err := b.Build(); err == nil {
+		t.Errorf("expected the builder to collect every mistake")
+	} else if msg := err.Error(); !strings.HasPrefix(msg, "flow builder has 4 problem") {
+		t.Errorf("expected four problems, got %v", err)
+	}
+
+	// structural problems come from validation as usual
+	b = NewBuilder[*Butterfly]()
+	b.Stage(stageEgg, Initial()).Stage(stageMoth)
+	b.From(stageEgg).On(actionHatch).GoTo(stageCaterpillar)
+	_, err := b.Build()
+	structureErrs := StructureErrors{}
+	if !errors.As(err, &structureErrs) || !structureErrs.Has(UnreachableStage) {
+		t.Errorf("expected the moth to be unreachable, got %v", err)
+	}
+}
+
+func TestSafeBuilderDeclarationOrder(t *testing.T) {
+	// a catch-all after a more specific branch is settled by declaration order, which is fine
+	b := NewBuilder[*Butterfly]()
+	b.From(stageCocoon).On(actionEmerge).When("isBrown", true).GoTo(stageMoth)
+	b.From(stageCocoon).On(actionEmerge).GoTo(stageButterfly)
+	flow, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change, err := flow.TakeAction(&Butterfly{color: "brown", lifeStage: stageCocoon}, actionEmerge); err != nil || change != stageMoth {
+		t.Errorf("expected the first branch to win, got %s, %v", change, err)
+	}
+	if change, err := flow.TakeAction(&Butterfly{color: "green", lifeStage: stageCocoon}, actionEmerge); err != nil || change != stageButterfly {
+		t.Errorf("expected the catch-all, got %s, %v", change, err)
+	}
+
+	// callers who want no ambiguity at all can still ask
+	unfinished, _ := b.Unfinished()
+	if err := unfinished.Overlaps(); err == nil || !err.(StructureErrors).Has(OverlappingBranches) {
+		t.Errorf("expected the overlap to be reported on request, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package flowchart
+
+import (
+	"context"
+	"sync"
+)
+
+// Versioned assets protect themselves from concurrent TakeAction calls. The version is read before the
+// status and context, and the new status is only written if the version is still the same; otherwise
+// CompareAndSetStatus should return an error matching ErrConflict and change nothing. Assets that
+// implement it never have SetStatus called by TakeAction.
+type Versioned interface {
+	GetVersion(ctx context.Context) (uint64, error)
+	CompareAndSetStatus(ctx context.Context, version uint64, newStatus string, action string) error
+}
+
+// Locker serializes TakeAction calls on the same asset, for assets that can't be Versioned.
+// Lock blocks until the asset is free or ctx is done, and the flow calls unlock once the attempt
+// (including its hooks) is over, so hooks mustn't take actions on the same asset.
+type Locker interface {
+	Lock(ctx context.Context, assetID string) (unlock func(), err error)
+}
+
+// SetLocker makes every TakeAction hold the asset's lock while it reads and writes the asset; pass nil to stop.
+// Assets are locked under the same ID they're recorded in history with. Like hooks, it applies to every copy of the flow.
+func (f *Flow[Asset]) SetLocker(locker Locker) {
+	f.configure(func(settings *flowSettings) { settings.locker = locker })
+}
+
+// SetConflictRetries lets TakeAction start over up to retries times when a Versioned asset reports
+// ErrConflict. Each attempt re-reads the asset, so a retry may well be refused by the new status.
+func (f *Flow[Asset]) SetConflictRetries(retries int) {
+	f.configure(func(settings *flowSettings) { settings.conflictRetries = retries })
+}
+
+// setStatus writes the destination, compare-and-set if the asset is Versioned
+func setStatus(ctx context.Context, asset Flowable, versioned Versioned, version uint64, destination, action string) error {
+	if versioned != nil {
+		return versioned.CompareAndSetStatus(ctx, version, destination, action)
+	}
+	return adaptFlowable(asset).SetStatusCtx(ctx, destination, action)
+}
+
+// MemoryLocker is a Locker for assets that live in this process. It is safe for concurrent use.
+type MemoryLocker struct {
+	mutex sync.Mutex
+	locks map[string]*assetLock
+}
+
+// assetLock is a one slot semaphore, so waiting for it can be cancelled
+type assetLock struct {
+	slot  chan struct{}
+	users int // holders and waiters; the lock is forgotten when this drops to zero
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: map[string]*assetLock{}}
+}
+
+func (l *MemoryLocker) Lock(ctx context.Context, assetID string) (func(), error) {
+	l.mutex.Lock()
+	lock, OK := l.locks[assetID]
+	if !OK {
+		lock = &assetLock{slot: make(chan struct{}, 1)}
+		l.locks[assetID] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	select {
+	case lock.slot <- struct{}{}:
+	case <-ctx.Done():
+		l.release(assetID, lock)
+		return nil, ctx.Err()
+	}
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			<-lock.slot
+			l.release(assetID, lock)
+		})
+	}, nil
+}
+
+func (l *MemoryLocker) release(assetID string, lock *assetLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(l.locks, assetID)
+	}
+}
@@ -0,0 +1,161 @@
+package flowchart
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// VersionedButterfly is a Butterfly that can be shared between goroutines
+type VersionedButterfly struct {
+	mutex   sync.Mutex
+	bug     Butterfly
+	version uint64
+	moves   int
+}
+
+func (v *VersionedButterfly) GetStatus() (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.bug.GetStatus()
+}
+
+func (v *VersionedButterfly) SetStatus(status, action string) error {
+	return errors.New("versioned butterflies should only be moved with CompareAndSetStatus")
+}
+
+func (v *VersionedButterfly) GetContext() (ValidationTable, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.bug.GetContext()
+}
+
+func (v *VersionedButterfly) GetVersion(_ context.Context) (uint64, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.version, nil
+}
+
+func (v *VersionedButterfly) CompareAndSetStatus(_ context.Context, version uint64, status, action string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if version != v.version {
+		return ErrConflict
+	}
+	v.version++
+	v.moves++
+	return v.bug.SetStatus(status, action)
+}
+
+// hammer runs action on asset from many goroutines at once and collects the results
+func hammer[Asset Flowable](flow Flow[Asset], asset Asset, action string) (moved int, errs []error) {
+	const goroutines = 50
+	results := make(chan error, goroutines)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for ii := 0; ii < goroutines; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := flow.TakeAction(asset, action)
+			results <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		if err == nil {
+			moved++
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	return moved, errs
+}
+
+func TestSafeVersionedConflicts(t *testing.T) {
+	unfinished := NewFlow[*VersionedButterfly]()
+	unfinished.Stages = buildSimpleFlow().Stages
+	unfinished.Transitions = buildSimpleFlow().Transitions
+	flow := unfinished.Finish()
+
+	Victor := VersionedButterfly{bug: Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 1}}
+	moved, errs := hammer(flow, &Victor, actionAge)
+	if moved != 1 || Victor.moves != 1 || Victor.bug.lifeStage != stageMoth {
+		t.Fatalf("expected exactly one move to %s, got %d (%d writes) ending in %s", stageMoth, moved, Victor.moves, Victor.bug.lifeStage)
+	}
+	for _, err := range errs {
+		// losers either lost the race outright, or started after it was over
+		if !errors.Is(err, ErrConflict) && !errors.Is(err, ErrActionNotAllowed) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	// with retries, a loser starts over and is refused by the moth stage instead
+	flow.SetConflictRetries(100)
+	Vera := VersionedButterfly{bug: Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 1}}
+	moved, errs = hammer(flow, &Vera, actionAge)
+	if moved != 1 || Vera.moves != 1 {
+		t.Fatalf("expected exactly one move with retries, got %d", moved)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrActionNotAllowed) {
+			t.Errorf("expected every retried loser to be refused by the new stage, got %v", err)
+		}
+	}
+}
+
+// LockedButterfly counts writes but does nothing to protect itself
+type LockedButterfly struct {
+	Butterfly
+	moves int
+}
+
+func (bug *LockedButterfly) SetStatus(status, action string) error {
+	bug.moves++
+	return bug.Butterfly.SetStatus(status, action)
+}
+
+func TestSafeLocker(t *testing.T) {
+	unfinished := NewFlow[*LockedButterfly]()
+	unfinished.Stages = buildSimpleFlow().Stages
+	unfinished.Transitions = buildSimpleFlow().Transitions
+	flow := unfinished.Finish()
+	locker := NewMemoryLocker()
+	flow.SetLocker(locker)
+
+	Lola := LockedButterfly{Butterfly: Butterfly{color: "green", lifeStage: stageCocoon, cocoonAge: 1}}
+	moved, errs := hammer(flow, &Lola, actionAge)
+	if moved != 1 || Lola.moves != 1 || Lola.lifeStage != stageButterfly {
+		t.Fatalf("expected exactly one move to %s, got %d (%d writes) ending in %s", stageButterfly, moved, Lola.moves, Lola.lifeStage)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrActionNotAllowed) {
+			t.Errorf("expected the rest to be refused by the new stage, got %v", err)
+		}
+	}
+	if len(locker.locks) != 0 {
+		t.Errorf("expected every lock to be released, %d left", len(locker.locks))
+	}
+
+	// waiting on a held lock gives up with the context
+	unlock, err := locker.Lock(context.Background(), assetID(&Lola))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := flow.TakeActionContext(ctx, &Lola, actionAge); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v waiting on the lock, got %v", context.DeadlineExceeded, err)
+	}
+	unlock()
+	unlock() // unlocking twice is harmless
+	if len(locker.locks) != 0 {
+		t.Errorf("expected every lock to be released, %d left", len(locker.locks))
+	}
+}
@@ -3,4 +3,5 @@ package flowchart
 const (
 	INVALID         = "INVALID"
 	originStageFlag = "IsFromStage%s"
+	regionStageFlag = "IsInRegion%sStage%s"
 )
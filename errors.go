@@ -0,0 +1,66 @@
+package flowchart
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotPointer       = errors.New("please pass a pointer to your asset")
+	ErrUnknownAction    = errors.New("action is not valid for this flow")
+	ErrUnknownStatus    = errors.New("status is not valid for this flow")
+	ErrActionNotAllowed = errors.New("action is not allowed for this status")
+	ErrNoOutcome        = errors.New("no outcome found given current validations")
+	ErrVetoed           = errors.New("transition vetoed by hook")
+	ErrPermissionDenied = errors.New("actor is not allowed to take this action")
+	ErrConflict         = errors.New("asset was changed by someone else during the transition")
+
+	// returned alongside a successful destination when the HistoryStore failed
+	ErrHistoryNotRecorded = errors.New("transition succeeded but was not recorded in history")
+)
+
+// TransitionError is returned by TakeAction once the asset's status is known. Err is, or wraps, one
+// of the sentinel errors above, so callers can use errors.Is on it directly.
+type TransitionError struct {
+	Status     string
+	Action     string
+	Context    ValidationTable
+	Candidates []Outcome // the branches of Action leaving Status, in the order they were tried
+	Err        error
+}
+
+func (e *TransitionError) Error() string {
+	switch e.Err {
+	case ErrUnknownStatus:
+		return fmt.Sprintf("calculated status '%s' is not valid for this flow", e.Status)
+	case ErrActionNotAllowed:
+		return fmt.Sprintf("given action '%s' is not allowed for the status %s", e.Action, e.Status)
+	case ErrNoOutcome:
+		return fmt.Sprintf("%v (action '%s' from status '%s', %d candidate branch(es))", e.Err, e.Action, e.Status, len(e.Candidates))
+	default:
+		return fmt.Sprintf("action '%s' from status '%s' failed: %v", e.Action, e.Status, e.Err)
+	}
+}
+
+func (e *TransitionError) Unwrap() error {
+	return e.Err
+}
+
+// causeError matches one of the sentinel errors while still unwrapping to whatever caused it,
+// e.g. the error a hook returned to veto a transition
+type causeError struct {
+	sentinel error
+	cause    error
+}
+
+func (e causeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.sentinel, e.cause)
+}
+
+func (e causeError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e causeError) Unwrap() error {
+	return e.cause
+}
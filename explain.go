@@ -0,0 +1,65 @@
+package flowchart
+
+import (
+	"context"
+	"fmt"
+)
+
+// BranchExplanation pairs one candidate branch with what the asset's context got wrong for it.
+// Diff covers the branch's table; a guard can only pass or fail as a whole.
+type BranchExplanation struct {
+	Outcome
+	Diff        ValidationDiff
+	GuardFailed bool
+}
+
+// Matches reports whether the branch would have been taken, had no earlier branch matched first
+func (e BranchExplanation) Matches() bool {
+	return e.Diff.Empty() && !e.GuardFailed
+}
+
+// Explain compares the evaluated context against every candidate branch, in the order they were tried
+func (e *TransitionError) Explain() []BranchExplanation {
+	return explainOutcomes(e.Context, e.Candidates)
+}
+
+// ExplainAction reports, for every branch of action leaving the asset's current stage, which tags the
+// asset's context is missing or has the wrong flag for. Errors are the same ones TakeAction would
+// return before it got as far as picking a branch.
+func (f Flow[Asset]) ExplainAction(asset Asset, action string) ([]BranchExplanation, error) {
+	return f.ExplainActionAs(Actor{}, asset, action)
+}
+
+// ExplainActionAs is ExplainAction for a particular actor, so an action they may not take is
+// reported as ErrPermissionDenied rather than explained
+func (f Flow[Asset]) ExplainActionAs(actor Actor, asset Asset, action string) ([]BranchExplanation, error) {
+	if !isPointer(asset) {
+		return nil, fmt.Errorf("%w in ExplainAction()", ErrNotPointer)
+	}
+	if _, OK := f.transitions[action]; !OK {
+		return nil, fmt.Errorf("given action '%s': %w", action, ErrUnknownAction)
+	}
+
+	ctx := context.Background()
+	status, validations, err := f.currentState(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := f.candidates(ctx, actor, status, validations, action)
+	if err != nil {
+		return nil, err
+	}
+	return explainOutcomes(validations, candidates), nil
+}
+
+func explainOutcomes(evaluated ValidationTable, candidates []Outcome) []BranchExplanation {
+	explanations := make([]BranchExplanation, 0, len(candidates))
+	for _, candidate := range candidates {
+		explanations = append(explanations, BranchExplanation{
+			Outcome:     candidate,
+			Diff:        evaluated.diffAgainst(candidate.When),
+			GuardFailed: !candidate.Guard.Evaluate(evaluated),
+		})
+	}
+	return explanations
+}
@@ -0,0 +1,76 @@
+package flowchart
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSafeExplainAction(t *testing.T) {
+	flow := generateSimpleFlow()
+	Oscar := Butterfly{
+		color:     "brown",
+		lifeStage: stageCocoon,
+		cocoonAge: 0,
+	}
+
+	explanations, err := flow.ExplainAction(&Oscar, actionAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanations) != 3 {
+		t.Fatalf("expected all three cocoon branches, got %v", explanations)
+	}
+	for _, explanation := range explanations {
+		switch explanation.Destination {
+		case stageCocoon:
+			if !explanation.Diff.Empty() {
+				t.Errorf("an unfinished cocoon should match the cocoon branch, got %v", explanation.Diff)
+			}
+		case stageMoth:
+			if len(explanation.Diff.Mismatched) != 1 || explanation.Diff.Mismatched[0] != "isFinishedMetamorphosing" {
+				t.Errorf("expected only isFinishedMetamorphosing to be wrong for %s, got %v", stageMoth, explanation.Diff)
+			}
+		case stageButterfly:
+			if len(explanation.Diff.Mismatched) != 2 {
+				t.Errorf("expected isBrown and isFinishedMetamorphosing to be wrong for %s, got %v", stageButterfly, explanation.Diff)
+			}
+		}
+	}
+
+	// the same detail is available straight from a failed TakeAction
+	_, err = flow.TakeAction(&Butterfly{color: "green", lifeStage: stageEgg}, actionSeen)
+	var tranErr *TransitionError
+	if !errors.As(err, &tranErr) {
+		t.Fatalf("expected a TransitionError, got %v", err)
+	}
+	explained := tranErr.Explain()
+	if len(explained) != 1 || len(explained[0].Diff.Mismatched) != 1 || explained[0].Diff.Mismatched[0] != "isGreen" {
+		t.Errorf("expected isGreen to be the only problem, got %v", explained)
+	}
+
+	// missing tags are reported separately from wrong ones
+	context, _ := NewValidationTable("isGreen", true)
+	canon, _ := NewValidationTable("isGreen", false, "isBrown", true)
+	diff := context.diffAgainst(canon)
+	if len(diff.Missing) != 1 || diff.Missing[0] != "isBrown" || len(diff.Mismatched) != 1 || diff.Mismatched[0] != "isGreen" {
+		t.Errorf("unexpected diff %v", diff)
+	}
+}
+
+func TestSafeExplainActionPermissions(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	age := unfinished.Transitions[actionAge]
+	age.Roles = []string{"gardener"}
+	unfinished.Transitions[actionAge] = age
+	flow := unfinished.Finish()
+
+	// a branch that would match is no use to someone who can't take the action
+	Petra := Butterfly{color: "green", lifeStage: stageEgg}
+	if _, err := flow.ExplainAction(&Petra, actionAge); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected %v for an anonymous actor, got %v", ErrPermissionDenied, err)
+	}
+	explanations, err := flow.ExplainActionAs(Actor{ID: "gail", Roles: []string{"gardener"}}, &Petra, actionAge)
+	if err != nil || len(explanations) != 1 || !explanations[0].Matches() {
+		t.Errorf("expected the gardener's branch to match, got %v, %v", explanations, err)
+	}
+}
@@ -0,0 +1,144 @@
+package flowchart
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DOT renders the flow as a Graphviz digraph. Every branch an asset can take from each stage becomes
+// an edge labelled with the action and, when the branch checks anything, its guard condition.
+func (f Flow[Asset]) DOT() (string, error) {
+	edges, err := f.exportEdges()
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	out.WriteString("digraph flow {\n")
+	for _, name := range sortedKeys(f.stages) {
+		fmt.Fprintf(&out, "\t%s;\n", dotQuote(name))
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&out, "\t%s -> %s [label=%s];\n", dotQuote(edge.from), dotQuote(edge.to), dotQuote(edge.label))
+	}
+	out.WriteString("}\n")
+	return out.String(), nil
+}
+
+// Mermaid renders the flow as a Mermaid stateDiagram-v2, with the same edges and labels as DOT
+func (f Flow[Asset]) Mermaid() (string, error) {
+	edges, err := f.exportEdges()
+	if err != nil {
+		return "", err
+	}
+
+	// destinations that aren't stages still need an id
+	names := sortedKeys(f.stages)
+	for _, edge := range edges {
+		for _, name := range []string{edge.from, edge.to} {
+			if _, OK := f.stages[name]; !OK && !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	ids := mermaidIDs(names)
+
+	var out strings.Builder
+	out.WriteString("stateDiagram-v2\n")
+	for _, name := range names {
+		if id := ids[name]; id != name {
+			fmt.Fprintf(&out, "\tstate \"%s\" as %s\n", strings.ReplaceAll(name, `"`, "'"), id)
+		} else {
+			fmt.Fprintf(&out, "\t%s\n", id)
+		}
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&out, "\t%s --> %s : %s\n", ids[edge.from], ids[edge.to], edge.label)
+	}
+	return out.String(), nil
+}
+
+type exportEdge struct {
+	from, to, label string
+}
+
+// exportEdges lists the same edges the graph queries follow, from every stage an asset can be in, so
+// a parent's transitions are drawn from each of its children. Unlike the graph queries, branches to
+// stages the flow doesn't have are drawn too.
+func (f Flow[Asset]) exportEdges() ([]exportEdge, error) {
+	all, err := f.flowEdges()
+	if err != nil {
+		return nil, err
+	}
+	edges := []exportEdge{}
+	for _, stage := range f.occupiable() {
+		for _, edge := range all[stage] {
+			label := edge.Action
+			if guard := guardLabel(edge.outcome); guard != "" {
+				label = fmt.Sprintf("%s [%s]", edge.Action, guard)
+			}
+			edges = append(edges, exportEdge{from: edge.From, to: edge.To, label: label})
+		}
+	}
+	return edges, nil
+}
+
+// guardLabel prints the branch condition in guard form, leaving out the origin stage flag
+func guardLabel(outcome Outcome) string {
+	originFlag := fmt.Sprintf(originStageFlag, outcome.Origin)
+	terms := []Guard{}
+	for _, tag := range outcome.When.tags {
+		if tag != originFlag {
+			terms = append(terms, Flag(tag, outcome.When.table[tag]))
+		}
+	}
+	if !outcome.Guard.IsZero() {
+		terms = append(terms, outcome.Guard)
+	}
+
+	switch len(terms) {
+	case 0:
+		return ""
+	case 1:
+		return terms[0].String()
+	default:
+		return AllOf(terms...).String()
+	}
+}
+
+func dotQuote(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
+
+var mermaidUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// mermaidIDs turns stage names into something Mermaid accepts as state ids. Names that come out the
+// same, like "in flight" and "in_flight", get a number on the end so they stay separate states.
+func mermaidIDs(names []string) map[string]string {
+	ids := map[string]string{}
+	taken := map[string]bool{}
+	// names that are already safe keep themselves as their id
+	for _, name := range names {
+		if mermaidUnsafe.ReplaceAllString(name, "_") == name && name != "" {
+			ids[name] = name
+			taken[name] = true
+		}
+	}
+	for _, name := range names {
+		if _, OK := ids[name]; OK {
+			continue
+		}
+		base := mermaidUnsafe.ReplaceAllString(name, "_")
+		if base == "" {
+			base = "_"
+		}
+		id := base
+		for suffix := 2; taken[id]; suffix++ {
+			id = fmt.Sprintf("%s_%d", base, suffix)
+		}
+		ids[name] = id
+		taken[id] = true
+	}
+	return ids
+}
@@ -0,0 +1,134 @@
+package flowchart
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeFlowExport(t *testing.T) {
+	flow := generateSimpleFlow()
+
+	dot, err := flow.DOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mermaid, err := flow.Mermaid()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type exportTest struct {
+		note   string
+		output string
+		want   []string
+	}
+	exportTests := []exportTest{
+		{
+			note:   "dot",
+			output: dot,
+			want: []string{
+				"digraph flow {\n",
+				"\t\"egg\" -> \"caterpillar\" [label=\"age\"];\n",
+				"\t\"cocoon\" -> \"moth\" [label=\"age [isBrown & isFinishedMetamorphosing]\"];\n",
+				"\t\"cocoon\" -> \"cocoon\" [label=\"age [!isFinishedMetamorphosing]\"];\n",
+				"\t\"moth\" -> \"eaten\" [label=\"seen [!isGreen]\"];\n",
+			},
+		},
+		{
+			note:   "mermaid",
+			output: mermaid,
+			want: []string{
+				"stateDiagram-v2\n",
+				"\tegg --> caterpillar : age\n",
+				"\tcocoon --> butterfly : age [!isBrown & isFinishedMetamorphosing]\n",
+				"\tcocoon --> cocoon : age [!isFinishedMetamorphosing]\n",
+				"\tbutterfly --> eaten : seen [!isGreen]\n",
+			},
+		},
+	}
+	for _, test := range exportTests {
+		for _, want := range test.want {
+			if !strings.Contains(test.output, want) {
+				t.Errorf("test: %s \n expected %q in:\n%s", test.note, want, test.output)
+			}
+		}
+	}
+
+	// names that aren't valid mermaid ids get an alias
+	unfinished := NewFlow[*Butterfly]()
+	unfinished.AddStages(NewStage("in flight"))
+	mermaid, _ = unfinished.Finish().Mermaid()
+	if !strings.Contains(mermaid, "\tstate \"in flight\" as in_flight\n") {
+		t.Errorf("expected an alias for 'in flight' in:\n%s", mermaid)
+	}
+}
+
+func TestSafeFlowExportAwkwardNames(t *testing.T) {
+	unfinished := NewFlow[*Butterfly]()
+	spaced, underscored := NewStage("in flight"), NewStage("in_flight")
+	landed := NewStage("landed")
+	blank, _ := NewValidationTable()
+	land := NewTransition("land")
+	land.AddStage(&spaced, blank, landed)
+	land.AddStage(&underscored, blank, landed)
+	// an origin-less branch applies from every stage with the transition
+	land.NextStages[" "] = "landed"
+	unfinished.AddStages(spaced, underscored, landed)
+	unfinished.AddTransitions(land)
+	flow := unfinished.Finish()
+
+	mermaid, err := flow.Mermaid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\tstate \"in flight\" as in_flight_2\n",
+		"\tin_flight\n",
+		"\tin_flight_2 --> landed : land\n",
+		"\tin_flight --> landed : land\n",
+	} {
+		if !strings.Contains(mermaid, want) {
+			t.Errorf("expected %q in\n%s", want, mermaid)
+		}
+	}
+	if strings.Contains(mermaid, "\t -->") || strings.Count(mermaid, "--> landed") != 4 {
+		t.Errorf("expected the origin-less branch drawn from both stages, got\n%s", mermaid)
+	}
+
+	dot, err := flow.DOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dot, `"" ->`) || strings.Count(dot, `-> "landed"`) != 4 {
+		t.Errorf("expected the origin-less branch drawn from both stages, got\n%s", dot)
+	}
+}
+
+func TestSafeFlowExportMatchesRuntime(t *testing.T) {
+	unfinished := buildNestedFlow()
+	// the cocoon doesn't list seen, so this branch can never be taken
+	seen := unfinished.Transitions[actionSeen]
+	seen.NextStages["IsFromStagecocoon:true"] = stageEaten
+	unfinished.Transitions[actionSeen] = seen
+	flow := unfinished.Finish()
+
+	dot, err := flow.DOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the exposed stage's seen transition is drawn from each of its children instead
+	for _, want := range []string{
+		"\t\"egg\" -> \"eaten\" [label=\"seen [!isGreen]\"];\n",
+		"\t\"moth\" -> \"moth\" [label=\"seen [isBrown]\"];\n",
+		"\t\"moth\" -> \"eaten\" [label=\"seen [!isGreen]\"];\n",
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("expected %q in\n%s", want, dot)
+		}
+	}
+	for _, unwanted := range []string{"\t\"exposed\" ->", "\t\"cocoon\" -> \"eaten\""} {
+		if strings.Contains(dot, unwanted) {
+			t.Errorf("didn't expect %q in\n%s", unwanted, dot)
+		}
+	}
+}
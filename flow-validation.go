@@ -0,0 +1,291 @@
+package flowchart
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type StructureErrorKind string
+
+const (
+	DanglingDestination    StructureErrorKind = "dangling destination"
+	UnregisteredTransition StructureErrorKind = "unregistered transition"
+	OrphanTransition       StructureErrorKind = "transition without origin"
+	UnknownOrigin          StructureErrorKind = "unknown origin stage"
+	DuplicateStage         StructureErrorKind = "duplicate stage"
+	DuplicateTransition    StructureErrorKind = "duplicate transition"
+	UnknownStartStage      StructureErrorKind = "unknown start stage"
+	UnreachableStage       StructureErrorKind = "unreachable stage"
+	OverlappingBranches    StructureErrorKind = "overlapping branches"
+	TerminalTransition     StructureErrorKind = "transition out of terminal stage"
+	UnknownParent          StructureErrorKind = "unknown parent stage"
+	ParentCycle            StructureErrorKind = "stage is its own ancestor"
+	MalformedBranch        StructureErrorKind = "malformed branch"
+	UncheckedBranches      StructureErrorKind = "branches too complex to check for overlap"
+)
+
+// StructureError describes a single problem found while validating the shape of a flow.
+// Stage and Transition are filled in whenever they apply to the problem.
+type StructureError struct {
+	Kind       StructureErrorKind
+	Stage      string
+	Transition string
+	Branches   []ValidationString // the clashing keys, for OverlappingBranches and UncheckedBranches; the unreadable key, for MalformedBranch
+}
+
+func (e StructureError) Error() string {
+	switch {
+	case len(e.Branches) > 0:
+		return fmt.Sprintf("%s: stage '%s', transition '%s', tables %q", e.Kind, e.Stage, e.Transition, e.Branches)
+	case e.Stage != "" && e.Transition != "":
+		return fmt.Sprintf("%s: stage '%s', transition '%s'", e.Kind, e.Stage, e.Transition)
+	case e.Transition != "":
+		return fmt.Sprintf("%s: transition '%s'", e.Kind, e.Transition)
+	default:
+		return fmt.Sprintf("%s: stage '%s'", e.Kind, e.Stage)
+	}
+}
+
+// StructureErrors is the full report returned by Validate; it is only ever returned non-empty
+type StructureErrors []StructureError
+
+func (errs StructureErrors) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("flow has %d structural problem(s): %s", len(errs), strings.Join(messages, "; "))
+}
+
+// Has reports whether any of the problems is of the given kind
+func (errs StructureErrors) Has(kind StructureErrorKind) bool {
+	for _, err := range errs {
+		if err.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// FinishValidated is Finish with a structural check of the whole graph first. If any starting
+// stages are given, or any stages are marked Initial, every other stage must be reachable from at least one of them.
+func (f UnfinishedFlow[Asset]) FinishValidated(start ...string) (Flow[Asset], error) {
+	if err := f.Validate(start...); err != nil {
+		return Flow[Asset]{}, err
+	}
+	return f.Finish(), nil
+}
+
+// Validate walks every stage and transition in the flow and returns a StructureErrors listing
+// everything wrong with it, or nil if the flow is sound.
+func (f UnfinishedFlow[Asset]) Validate(start ...string) error {
+	errs := StructureErrors{}
+
+	for _, name := range f.duplicateStages {
+		errs = append(errs, StructureError{Kind: DuplicateStage, Stage: name})
+	}
+	for _, name := range f.duplicateTransitions {
+		errs = append(errs, StructureError{Kind: DuplicateTransition, Transition: name})
+	}
+
+	// every transition a stage claims must be registered
+	missingParents := []string{}
+	for _, stageName := range sortedKeys(f.Stages) {
+		stage := f.Stages[stageName]
+		if stage.Name != stageName {
+			errs = append(errs, StructureError{Kind: DuplicateStage, Stage: stage.Name})
+		}
+		for _, action := range stage.Transitions {
+			if _, OK := f.Transitions[action]; !OK {
+				errs = append(errs, StructureError{Kind: UnregisteredTransition, Stage: stageName, Transition: action})
+			}
+			if stage.Terminal {
+				errs = append(errs, StructureError{Kind: TerminalTransition, Stage: stageName, Transition: action})
+			}
+		}
+		// a terminal stage doesn't take its parents' transitions either, which is worth knowing about
+		if stage.Terminal {
+			inherited := []string{}
+			for _, parent := range ancestry(f.Stages, stageName)[1:] {
+				for _, action := range f.Stages[parent].Transitions {
+					if !contains(stage.Transitions, action) && !contains(inherited, action) {
+						inherited = append(inherited, action)
+						errs = append(errs, StructureError{Kind: TerminalTransition, Stage: stageName, Transition: action})
+					}
+				}
+			}
+		}
+
+		// parents must exist, and can't loop back round
+		if _, OK := f.Stages[stage.Parent]; stage.Parent != "" && !OK && !contains(missingParents, stage.Parent) {
+			missingParents = append(missingParents, stage.Parent)
+			errs = append(errs, StructureError{Kind: UnknownParent, Stage: stage.Parent})
+		}
+		if chain := ancestry(f.Stages, stageName); stage.Parent != "" && f.Stages[chain[len(chain)-1]].Parent == stageName {
+			errs = append(errs, StructureError{Kind: ParentCycle, Stage: stageName})
+		}
+	}
+
+	// every transition needs an origin, and every branch must lead somewhere real
+	edges := map[string][]string{}
+	originless := map[string][]string{} // by transition, for branches that apply from any stage allowing it
+	for _, tranName := range sortedKeys(f.Transitions) {
+		tran := f.Transitions[tranName]
+		if tran.Name != tranName {
+			errs = append(errs, StructureError{Kind: DuplicateTransition, Transition: tran.Name})
+		}
+
+		hasOrigin := false
+		for _, stage := range f.Stages {
+			if contains(stage.Transitions, tranName) {
+				hasOrigin = true
+				break
+			}
+		}
+		if !hasOrigin {
+			errs = append(errs, StructureError{Kind: OrphanTransition, Transition: tranName})
+		}
+
+		reported := map[string]bool{}
+		for _, canon := range sortedKeys(tran.NextStages) {
+			destination := tran.NextStages[canon]
+			origin, err := branchOrigin(canon)
+			if err != nil {
+				errs = append(errs, StructureError{Kind: MalformedBranch, Transition: tranName, Branches: []ValidationString{canon}})
+				continue
+			}
+			if _, OK := f.Stages[origin]; origin != "" && !OK && !reported["origin:"+origin] {
+				reported["origin:"+origin] = true
+				errs = append(errs, StructureError{Kind: UnknownOrigin, Stage: origin, Transition: tranName})
+			}
+			// branches can leave a terminal stage even when the stage doesn't list the transition
+			if stage := f.Stages[origin]; stage.Terminal && !contains(stage.Transitions, tranName) && !reported["terminal:"+origin] {
+				reported["terminal:"+origin] = true
+				errs = append(errs, StructureError{Kind: TerminalTransition, Stage: origin, Transition: tranName})
+			}
+			if _, OK := f.Stages[destination]; !OK && !reported[destination] {
+				reported[destination] = true
+				errs = append(errs, StructureError{Kind: DanglingDestination, Stage: destination, Transition: tranName})
+			}
+			if origin == "" {
+				originless[tranName] = append(originless[tranName], destination)
+				continue
+			}
+			edges[origin] = append(edges[origin], destination)
+		}
+
+	}
+
+	// everything should be reachable from the declared start, or from the initial stages if none was given
+	if len(start) == 0 {
+		start = initialStages(f.Stages)
+	}
+	if len(start) > 0 {
+		visited := map[string]bool{}
+		queue := []string{}
+		for _, name := range start {
+			if _, OK := f.Stages[name]; !OK {
+				errs = append(errs, StructureError{Kind: UnknownStartStage, Stage: name})
+				continue
+			}
+			visited[name] = true
+			queue = append(queue, name)
+		}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			// a stage can go wherever its parents can, unless it's terminal, and wherever the branches
+			// without an origin of any action it allows go
+			nexts := []string{}
+			for _, level := range actionSources(f.Stages, current) {
+				nexts = append(nexts, edges[level]...)
+			}
+			for _, action := range stageActions(f.Stages, current) {
+				nexts = append(nexts, originless[action]...)
+			}
+			for _, next := range nexts {
+				if !visited[next] {
+					visited[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		// parents are never occupied themselves, so they count as reached along with any of their children
+		for _, stageName := range sortedKeys(visited) {
+			for _, parent := range ancestry(f.Stages, stageName)[1:] {
+				visited[parent] = true
+			}
+		}
+		for _, stageName := range sortedKeys(f.Stages) {
+			if !visited[stageName] {
+				errs = append(errs, StructureError{Kind: UnreachableStage, Stage: stageName})
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Overlaps reports every pair of branches that could match the same context with nothing but
+// declaration order to choose between them. That's a perfectly good way to settle it, so Validate
+// doesn't check this; call it for flows that are meant to be unambiguous. Pairs whose guards have too
+// many combinations to check are reported as UncheckedBranches rather than as overlaps.
+func (f UnfinishedFlow[Asset]) Overlaps() error {
+	errs := StructureErrors{}
+	for _, tranName := range sortedKeys(f.Transitions) {
+		overlaps, unproven, err := f.Transitions[tranName].overlaps()
+		if err != nil {
+			errs = append(errs, StructureError{Kind: MalformedBranch, Transition: tranName})
+			continue
+		}
+		for _, pair := range overlaps {
+			errs = append(errs, overlapError(OverlappingBranches, tranName, pair))
+		}
+		for _, pair := range unproven {
+			errs = append(errs, overlapError(UncheckedBranches, tranName, pair))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func overlapError(kind StructureErrorKind, tranName string, pair [2]Outcome) StructureError {
+	return StructureError{
+		Kind:       kind,
+		Stage:      pair[0].Origin,
+		Transition: tranName,
+		Branches:   []ValidationString{pair[0].key(), pair[1].key()},
+	}
+}
+
+// branchOrigin pulls the origin stage back out of a canonical table written by Transition.AddStage.
+// It returns an empty string for tables that were built without an origin.
+func branchOrigin(canon ValidationString) (string, error) {
+	table, _, err := canon.toCondition()
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.TrimSuffix(originStageFlag, "%s")
+	for _, tag := range table.tags {
+		if strings.HasPrefix(tag, prefix) && table.table[tag] {
+			return strings.TrimPrefix(tag, prefix), nil
+		}
+	}
+	return "", nil
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
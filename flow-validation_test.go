@@ -0,0 +1,85 @@
+package flowchart
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSafeFlowValidation(t *testing.T) {
+	// the butterfly flows never register the eaten stage, so seen leads nowhere
+	_, err := buildGranularFlow().FinishValidated(stageEgg)
+	var structErrs StructureErrors
+	if !errors.As(err, &structErrs) {
+		t.Fatalf("expected StructureErrors, got %v", err)
+	}
+	if len(structErrs) != 1 || structErrs[0].Kind != DanglingDestination || structErrs[0].Stage != stageEaten {
+		t.Errorf("expected a single dangling destination for %s, got %v", stageEaten, structErrs)
+	}
+
+	// once eaten is registered both flows are sound
+	for _, build := range []func() UnfinishedFlow[*Butterfly]{buildGranularFlow, buildSimpleFlow} {
+		unfinished := build()
+		unfinished.AddStages(NewStage(stageEaten))
+		if _, err := unfinished.FinishValidated(stageEgg); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSafeFlowValidationProblems(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	unfinished.AddStages(NewStage(stageEaten), NewStage(stageEaten)) // duplicate
+
+	lonely := NewStage("lonely") // never reached from egg
+	lonely.addTransition("fly")  // never registered
+	unfinished.AddStages(lonely)
+
+	unfinished.AddTransitions(NewTransition("sleep")) // no stage uses it
+
+	err := unfinished.Validate(stageEgg, "nowhere")
+	var structErrs StructureErrors
+	if !errors.As(err, &structErrs) {
+		t.Fatalf("expected StructureErrors, got %v", err)
+	}
+	for _, kind := range []StructureErrorKind{DuplicateStage, UnregisteredTransition, OrphanTransition, UnknownStartStage, UnreachableStage} {
+		if !structErrs.Has(kind) {
+			t.Errorf("expected a %s problem in %v", kind, structErrs)
+		}
+	}
+	if structErrs.Has(DanglingDestination) {
+		t.Errorf("did not expect a dangling destination in %v", structErrs)
+	}
+
+	// no start means no reachability check
+	if err := unfinished.Validate(); err != nil && err.(StructureErrors).Has(UnreachableStage) {
+		t.Errorf("reachability should only be checked from a declared start")
+	}
+}
+
+func TestSafeFlowValidationMalformedBranch(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	seen := unfinished.Transitions[actionSeen]
+	seen.NextStages["IsFromStageegg:maybe"] = stageEaten
+	unfinished.Transitions[actionSeen] = seen
+
+	// the unreadable branch is one problem among the rest, not the end of the report
+	err := unfinished.Validate(stageEgg)
+	var structErrs StructureErrors
+	if !errors.As(err, &structErrs) {
+		t.Fatalf("expected StructureErrors, got %v", err)
+	}
+	if !structErrs.Has(MalformedBranch) || !structErrs.Has(DanglingDestination) {
+		t.Errorf("expected both the malformed branch and the dangling destination in %v", structErrs)
+	}
+}
+
+func TestSafeFlowValidationOriginlessBranch(t *testing.T) {
+	// y is only reached by a branch without an origin, which x's go action follows
+	unfinished := buildOriginlessFlow()
+	if err := unfinished.Validate("x"); err != nil {
+		t.Errorf("expected y to be reachable from x, got %v", err)
+	}
+	if _, err := unfinished.FinishValidated("x"); err != nil {
+		t.Errorf("expected the flow to finish, got %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package flowchart
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,19 +15,59 @@ type Flowable interface {
 	GetContext() (ValidationTable, error)
 }
 
+// FlowableCtx is the context-aware version of Flowable, for assets whose status lives somewhere that
+// should honor deadlines and cancellation. It's an addition to Flowable, not a replacement: every asset
+// has to be a Flowable to be used with a Flow, and those that implement FlowableCtx as well get the
+// caller's context on every call the flow makes, with the plain methods left for anything else.
+type FlowableCtx interface {
+	GetStatusCtx(ctx context.Context) (string, error)
+	SetStatusCtx(ctx context.Context, newStatus string, action string) error
+	GetContextCtx(ctx context.Context) (ValidationTable, error)
+}
+
+// adaptFlowable picks the FlowableCtx methods of an asset that has them, or wraps the plain ones and ignores the context
+func adaptFlowable(asset Flowable) FlowableCtx {
+	if ctxAsset, OK := asset.(FlowableCtx); OK {
+		return ctxAsset
+	}
+	return flowableAdapter{asset}
+}
+
+type flowableAdapter struct {
+	asset Flowable
+}
+
+func (a flowableAdapter) GetStatusCtx(_ context.Context) (string, error) {
+	return a.asset.GetStatus()
+}
+
+func (a flowableAdapter) SetStatusCtx(_ context.Context, newStatus string, action string) error {
+	return a.asset.SetStatus(newStatus, action)
+}
+
+func (a flowableAdapter) GetContextCtx(_ context.Context) (ValidationTable, error) {
+	return a.asset.GetContext()
+}
+
 type UnfinishedFlow[Asset Flowable] struct {
 	Stages      map[string]Stage
 	Transitions map[string]Transition
+
+	// names that were added more than once; the later value wins in the maps above
+	duplicateStages      []string
+	duplicateTransitions []string
 }
 type Flow[Asset Flowable] struct {
 	stages      map[string]Stage
 	transitions map[string]Transition
+	shared      *flowRegistry[Asset] // hooks and settings, shared by every copy made after Finish
 }
 
 func (f UnfinishedFlow[Asset]) Finish() Flow[Asset] {
 	newFlow := Flow[Asset]{
 		stages:      f.Stages,
 		transitions: f.Transitions,
+		shared:      newFlowRegistry[Asset](),
 	}
 	return newFlow
 }
@@ -39,61 +81,250 @@ func NewFlow[Asset Flowable]() UnfinishedFlow[Asset] {
 
 func (f *UnfinishedFlow[Asset]) AddStages(stages ...Stage) {
 	for _, stage := range stages {
+		if _, exists := f.Stages[stage.Name]; exists {
+			f.duplicateStages = append(f.duplicateStages, stage.Name)
+		}
 		f.Stages[stage.Name] = stage
 	}
 }
 
 func (f *UnfinishedFlow[Asset]) AddTransitions(transitions ...Transition) {
 	for _, transition := range transitions {
+		if _, exists := f.Transitions[transition.Name]; exists {
+			f.duplicateTransitions = append(f.duplicateTransitions, transition.Name)
+		}
 		f.Transitions[transition.Name] = transition
 	}
 }
 
 func (f Flow[Asset]) TakeAction(asset Asset, action string) (string, error) {
+	return f.TakeActionContext(context.Background(), asset, action)
+}
+
+// TakeActionContext is TakeAction with a context that is passed along to the asset, if it implements
+// FlowableCtx, and to every hook
+func (f Flow[Asset]) TakeActionContext(ctx context.Context, asset Asset, action string) (string, error) {
+	return f.TakeActionAs(ctx, Actor{}, asset, action)
+}
+
+// TakeActionAs is TakeActionContext on behalf of someone. The actor's permissions are checked before
+// any branch is evaluated, and the actor is passed to hooks and recorded in history.
+func (f Flow[Asset]) TakeActionAs(ctx context.Context, actor Actor, asset Asset, action string) (string, error) {
+	settings := f.settings()
+	for attempt := 0; ; attempt++ {
+		entry := HistoryEntry{AssetID: assetID(asset), Actor: actor, Action: action, Time: time.Now()}
+		destination, err := f.takeAction(ctx, settings, actor, asset, action, &entry)
+		err = settings.recordHistory(ctx, entry, destination, err)
+		if errors.Is(err, ErrConflict) && attempt < settings.conflictRetries {
+			continue
+		}
+		return destination, err
+	}
+}
+
+// takeAction does the work of TakeActionAs, filling in entry as it goes
+func (f Flow[Asset]) takeAction(ctx context.Context, settings flowSettings, actor Actor, asset Asset, action string, entry *HistoryEntry) (string, error) {
+	if settings.locker != nil {
+		unlock, err := settings.locker.Lock(ctx, entry.AssetID)
+		if err != nil {
+			return INVALID, err
+		}
+		defer unlock()
+	}
+
+	// the version has to be read first, so any write after it is caught
+	versioned, _ := interface{}(asset).(Versioned)
+	var version uint64
+	if versioned != nil {
+		var err error
+		if version, err = versioned.GetVersion(ctx); err != nil {
+			return INVALID, err
+		}
+	}
+
+	resolved, err := f.resolve(ctx, actor, asset, action, "TakeAction()")
+	entry.Origin, entry.Context = resolved.status, resolved.validations
+	if err != nil {
+		return INVALID, err
+	}
+	outcome := resolved.outcome
+	entry.Branch = &outcome
+
+	// the branch may belong to a parent stage, but it's the asset's own stage being left
+	event := TransitionEvent[Asset]{
+		Context:     ctx,
+		Actor:       actor,
+		Asset:       asset,
+		Action:      action,
+		Origin:      resolved.status,
+		Destination: outcome.Destination,
+	}
+	exited, entered := stageBoundary(f.stages, resolved.status, outcome.Destination)
+	if err := f.shared.runBefore(event, exited); err != nil {
+		return INVALID, &TransitionError{Status: resolved.status, Action: action, Candidates: []Outcome{outcome}, Err: err}
+	}
+
+	// don't start a write the caller has already given up on
+	if err := ctx.Err(); err != nil {
+		return INVALID, err
+	}
+	if err := setStatus(ctx, asset, versioned, version, outcome.Destination, action); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return INVALID, &TransitionError{Status: resolved.status, Action: action, Candidates: []Outcome{outcome}, Err: err}
+		}
+		return INVALID, errors.Wrap(err, "call to f.statusSetter failed")
+	}
+
+	f.shared.runAfter(event, entered)
+	return outcome.Destination, nil
+}
+
+// PreviewAction runs every check TakeAction would and reports where the asset would end up, along
+// with the branch table that sent it there, but never calls SetStatus.
+func (f Flow[Asset]) PreviewAction(asset Asset, action string) (string, ValidationTable, error) {
+	resolved, err := f.resolve(context.Background(), Actor{}, asset, action, "PreviewAction()")
+	if err != nil {
+		return INVALID, ValidationTable{}, err
+	}
+	return resolved.outcome.Destination, resolved.outcome.When, nil
+}
+
+// ActionOption is one action an asset could attempt from its current stage
+type ActionOption struct {
+	Action      string
+	Destination string // INVALID when the action is blocked
+	Blocked     error  // why the action would fail right now; nil when it's available
+}
+
+// AvailableActions checks every transition of the asset's current stage against its current context.
+// Actions that would succeed come back in available with their destination, the rest in blocked with
+// the error TakeAction would have returned.
+func (f Flow[Asset]) AvailableActions(asset Asset) (available []ActionOption, blocked []ActionOption, err error) {
+	return f.AvailableActionsAs(Actor{}, asset)
+}
+
+// AvailableActionsAs is AvailableActions for a particular actor, so actions they aren't permitted to
+// take come back blocked with ErrPermissionDenied
+func (f Flow[Asset]) AvailableActionsAs(actor Actor, asset Asset) (available []ActionOption, blocked []ActionOption, err error) {
+	if !isPointer(asset) {
+		return nil, nil, fmt.Errorf("%w in AvailableActions()", ErrNotPointer)
+	}
+	status, validations, err := f.currentState(context.Background(), asset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, OK := f.stages[status]; !OK {
+		return nil, nil, &TransitionError{Status: status, Context: validations, Err: ErrUnknownStatus}
+	}
+
+	available, blocked = []ActionOption{}, []ActionOption{}
+	for _, action := range stageActions(f.stages, status) {
+		outcome, err := f.resolveFrom(context.Background(), actor, status, validations, action)
+		if err != nil {
+			blocked = append(blocked, ActionOption{Action: action, Destination: INVALID, Blocked: err})
+			continue
+		}
+		available = append(available, ActionOption{Action: action, Destination: outcome.Destination})
+	}
+	return available, blocked, nil
+}
+
+// resolution is what resolve worked out, filled in as far as it got before any error
+type resolution struct {
+	status      string
+	validations ValidationTable
+	outcome     Outcome
+}
+
+// resolve works out which branch of action the asset would take, without changing anything
+func (f Flow[Asset]) resolve(ctx context.Context, actor Actor, asset Asset, action string, caller string) (resolution, error) {
+	resolved := resolution{outcome: Outcome{Destination: INVALID}}
+
 	// check if asset is a pointer
 	if !isPointer(asset) {
-		return INVALID, fmt.Errorf("please pass a pointer to your asset in TakeAction()")
+		return resolved, fmt.Errorf("%w in %s", ErrNotPointer, caller)
 	}
 
 	// check if action is part of our flow
-	tran, OK := f.transitions[action]
-	if !OK {
-		return INVALID, fmt.Errorf("given action '%s' is not valid for this flow", action)
+	if _, OK := f.transitions[action]; !OK {
+		return resolved, fmt.Errorf("given action '%s': %w", action, ErrUnknownAction)
 	}
 
+	status, validations, err := f.currentState(ctx, asset)
+	if err != nil {
+		return resolved, err
+	}
+	resolved.status, resolved.validations = status, validations
+
+	outcome, err := f.resolveFrom(ctx, actor, status, validations, action)
+	if err != nil {
+		return resolved, err
+	}
+	resolved.outcome = outcome
+	return resolved, nil
+}
+
+// currentState reads the asset's status and context, with the origin stage flag already added
+func (f Flow[Asset]) currentState(ctx context.Context, asset Asset) (string, ValidationTable, error) {
+	ctxAsset := adaptFlowable(asset)
+
 	// get current stage and validations
-	status, err := asset.GetStatus()
+	status, err := ctxAsset.GetStatusCtx(ctx)
 	if err != nil {
-		return INVALID, err
+		return INVALID, ValidationTable{}, err
 	}
-	validations, err := asset.GetContext()
+	validations, err := ctxAsset.GetContextCtx(ctx)
 	if err != nil {
-		return INVALID, err
+		return INVALID, ValidationTable{}, err
 	}
 
-	// add origin stage flag to our validations
-	validations.AddFlag(fmt.Sprintf(originStageFlag, status), true)
+	// add origin stage flags to our validations, for the stage and every stage it sits in
+	for _, stage := range ancestry(f.stages, status) {
+		validations.AddFlag(fmt.Sprintf(originStageFlag, stage), true)
+	}
+	return status, validations, nil
+}
 
-	// check if current stage is part of our flow
-	stage, OK := f.stages[status]
+func (f Flow[Asset]) resolveFrom(ctx context.Context, actor Actor, status string, validations ValidationTable, action string) (Outcome, error) {
+	invalid := Outcome{Destination: INVALID}
+
+	// the stage's own branches come before its parents'
+	candidates, err := f.candidates(ctx, actor, status, validations, action)
+	if err != nil {
+		return invalid, err
+	}
+	for _, outcome := range candidates {
+		if outcome.matches(validations) {
+			return outcome, nil
+		}
+	}
+	return invalid, &TransitionError{Status: status, Action: action, Context: validations, Candidates: candidates, Err: ErrNoOutcome}
+}
+
+// candidates makes every check that comes before picking a branch, then lists the branches to try in order
+func (f Flow[Asset]) candidates(ctx context.Context, actor Actor, status string, validations ValidationTable, action string) ([]Outcome, error) {
+	tran, OK := f.transitions[action]
 	if !OK {
-		return INVALID, fmt.Errorf("calculated status '%s' is not valid for this flow", status)
+		return nil, fmt.Errorf("given action '%s': %w", action, ErrUnknownAction)
 	}
 
-	// check if transition is valid for that stage
-	if !contains(stage.Transitions, action) {
-		return INVALID, fmt.Errorf("given action '%s' is not allowed for the status %s", action, stage)
+	// check if current stage is part of our flow
+	if _, OK := f.stages[status]; !OK {
+		return nil, &TransitionError{Status: status, Action: action, Context: validations, Err: ErrUnknownStatus}
 	}
 
-	newStatus, err := tran.getOutcome(validations)
-	if err == nil {
-		if innerErr := asset.SetStatus(newStatus, action); innerErr != nil {
-			return INVALID, errors.Wrap(innerErr, "call to f.statusSetter failed")
-		}
+	// check if transition is valid for that stage, or a stage it sits in
+	levels := actionLevels(f.stages, status, action)
+	if len(levels) == 0 {
+		return nil, &TransitionError{Status: status, Action: action, Context: validations, Err: ErrActionNotAllowed}
 	}
 
-	return newStatus, err
+	// check if this actor may take the action at all
+	if err := f.authorize(ctx, actor, tran, status); err != nil {
+		return nil, &TransitionError{Status: status, Action: action, Context: validations, Err: err}
+	}
 
+	return tran.outcomesFromLevels(levels)
 }
 
 func contains(list []string, single string) bool {
@@ -1,6 +1,8 @@
 package flowchart
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -58,12 +60,21 @@ func (bug *Butterfly) GetContext() (ValidationTable, error) {
 	unrelatedTag := "isAdult"
 	isAdult := bug.lifeStage == stageButterfly || bug.lifeStage == stageMoth
 
-	return NewValidationTable(
+	table, err := NewValidationTable(
 		greenTag, isGreen,
 		brownTag, isBrown,
 		finishedTag, isFinished,
 		unrelatedTag, isAdult,
 	)
+	if err != nil {
+		return table, err
+	}
+
+	// typed values let guards make the decision instead, e.g. "cocoonAge >= 3"
+	if err := table.AddValue("cocoonAge", bug.cocoonAge); err != nil {
+		return table, err
+	}
+	return table, table.AddValue("color", bug.color)
 }
 
 // As an example, we will generate a flow for a butterfly
@@ -71,7 +82,7 @@ func (bug *Butterfly) GetContext() (ValidationTable, error) {
 // At almost any point it can be seen and eaten by a bird, but this only happens to non-green ones
 // coccoons are also safe from being eaten
 // Some butterflies (the brown ones) are secretly moths! So when they EMERGE they are moths, not butterflies
-func generateGranularFlow() Flow[*Butterfly] {
+func buildGranularFlow() UnfinishedFlow[*Butterfly] {
 	// generate a flow object with setters and getters for butterfly struct
 	tempButterflyFlow := NewFlow[*Butterfly]()
 
@@ -138,14 +149,16 @@ func generateGranularFlow() Flow[*Butterfly] {
 	tempButterflyFlow.AddStages(eggStage, catStage, cocoonStage, butterflyStage, mothStage)
 	tempButterflyFlow.AddTransitions(hatchTran, growTran, emergeTran, seenTran)
 
-	// you can't use a flow until you Finish it
-	butterflyFlow := tempButterflyFlow.Finish()
+	return tempButterflyFlow
+}
 
-	return butterflyFlow
+func generateGranularFlow() Flow[*Butterfly] {
+	// you can't use a flow until you Finish it
+	return buildGranularFlow().Finish()
 }
 
 // Same flow as above, but all growing actions are replaced with the simplified Age action
-func generateSimpleFlow() Flow[*Butterfly] {
+func buildSimpleFlow() UnfinishedFlow[*Butterfly] {
 	// generate a flow object with setters and getters for butterfly struct
 	tempButterflyFlow := NewFlow[*Butterfly]()
 
@@ -217,10 +230,11 @@ func generateSimpleFlow() Flow[*Butterfly] {
 	tempButterflyFlow.AddStages(eggStage, catStage, cocoonStage, butterflyStage, mothStage)
 	tempButterflyFlow.AddTransitions(ageTran, seenTran)
 
-	// you can't use a flow until you Finish it
-	butterflyFlow := tempButterflyFlow.Finish()
+	return tempButterflyFlow
+}
 
-	return butterflyFlow
+func generateSimpleFlow() Flow[*Butterfly] {
+	return buildSimpleFlow().Finish()
 }
 
 type butterflyTest struct {
@@ -427,3 +441,228 @@ func TestSafeButterfliesGetEaten(t *testing.T) {
 	runButterflyTests(&Quinton, eatenPathSimplified, generateSimpleFlow, t)
 
 }
+
+func TestSafeTakeActionErrors(t *testing.T) {
+	flow := generateGranularFlow()
+
+	type errorTest struct {
+		note   string
+		bug    *Butterfly
+		action string
+		want   error
+	}
+	errorTests := []errorTest{
+		{
+			note:   "unknown action",
+			bug:    &Butterfly{color: "red", lifeStage: stageEgg},
+			action: "fly",
+			want:   ErrUnknownAction,
+		},
+		{
+			note:   "unknown status",
+			bug:    &Butterfly{color: "red", lifeStage: "larva"},
+			action: actionHatch,
+			want:   ErrUnknownStatus,
+		},
+		{
+			note:   "action not allowed from this stage",
+			bug:    &Butterfly{color: "red", lifeStage: stageCocoon},
+			action: actionSeen,
+			want:   ErrActionNotAllowed,
+		},
+		{
+			note:   "green bugs can't be seen",
+			bug:    &Butterfly{color: "green", lifeStage: stageEgg},
+			action: actionSeen,
+			want:   ErrNoOutcome,
+		},
+	}
+
+	for _, test := range errorTests {
+		_, err := flow.TakeAction(test.bug, test.action)
+		if !errors.Is(err, test.want) {
+			t.Errorf("test: %s \n expected %v, got %v", test.note, test.want, err)
+		}
+	}
+
+	// a failed outcome carries everything that went into the decision
+	_, err := flow.TakeAction(&Butterfly{color: "green", lifeStage: stageEgg}, actionSeen)
+	var tranErr *TransitionError
+	if !errors.As(err, &tranErr) {
+		t.Fatalf("expected a TransitionError, got %v", err)
+	}
+	if tranErr.Status != stageEgg || tranErr.Action != actionSeen {
+		t.Errorf("wrong status or action on error: %s, %s", tranErr.Status, tranErr.Action)
+	}
+	if len(tranErr.Candidates) != 1 || tranErr.Candidates[0].Destination != stageEaten {
+		t.Errorf("expected the single branch to %s as a candidate, got %v", stageEaten, tranErr.Candidates)
+	}
+	if !tranErr.Context.table["isGreen"] {
+		t.Errorf("expected the evaluated context on the error")
+	}
+}
+
+func TestSafePreviewAction(t *testing.T) {
+	flow := generateGranularFlow()
+	Morgan := Butterfly{
+		color:     "brown",
+		lifeStage: stageCocoon,
+		cocoonAge: 1,
+	}
+
+	preview, branch, err := flow.PreviewAction(&Morgan, actionEmerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview != stageMoth {
+		t.Errorf("Wanted %s, got %s.", stageMoth, preview)
+	}
+	if flag, OK := branch.table["isBrown"]; !OK || !flag {
+		t.Errorf("expected the moth branch table, got %s", branch.toString())
+	}
+	if Morgan.lifeStage != stageCocoon {
+		t.Errorf("PreviewAction should not change the asset, but it is now %s", Morgan.lifeStage)
+	}
+
+	// previews fail exactly like the real thing
+	preview, _, err = flow.PreviewAction(&Morgan, actionSeen)
+	if !errors.Is(err, ErrActionNotAllowed) || preview != INVALID {
+		t.Errorf("expected %v, got %s, %v", ErrActionNotAllowed, preview, err)
+	}
+
+	// and the real thing agrees with the preview
+	change, err := flow.TakeAction(&Morgan, actionEmerge)
+	if err != nil || change != stageMoth {
+		t.Errorf("expected TakeAction to follow the preview to %s, got %s, %v", stageMoth, change, err)
+	}
+}
+
+func TestSafeAvailableActions(t *testing.T) {
+	flow := generateGranularFlow()
+
+	type availableTest struct {
+		note      string
+		bug       *Butterfly
+		available map[string]string // action to destination
+		blocked   []string
+	}
+	availableTests := []availableTest{
+		{
+			note:      "a red egg can hatch or be seen",
+			bug:       &Butterfly{color: "red", lifeStage: stageEgg},
+			available: map[string]string{actionHatch: stageCaterpillar, actionSeen: stageEaten},
+			blocked:   []string{},
+		},
+		{
+			note:      "a green caterpillar is hidden",
+			bug:       &Butterfly{color: "green", lifeStage: stageCaterpillar},
+			available: map[string]string{actionGrow: stageCocoon},
+			blocked:   []string{actionSeen},
+		},
+		{
+			note:      "a brown cocoon becomes a moth",
+			bug:       &Butterfly{color: "brown", lifeStage: stageCocoon},
+			available: map[string]string{actionEmerge: stageMoth},
+			blocked:   []string{},
+		},
+	}
+
+	for _, test := range availableTests {
+		available, blocked, err := flow.AvailableActions(test.bug)
+		if err != nil {
+			t.Errorf("test: %s \n %v", test.note, err)
+			continue
+		}
+		if len(available) != len(test.available) {
+			t.Errorf("test: %s \n expected %d available actions, got %v", test.note, len(test.available), available)
+		}
+		for _, option := range available {
+			if test.available[option.Action] != option.Destination {
+				t.Errorf("test: %s \n unexpected option %s -> %s", test.note, option.Action, option.Destination)
+			}
+		}
+		if len(blocked) != len(test.blocked) {
+			t.Errorf("test: %s \n expected %d blocked actions, got %v", test.note, len(test.blocked), blocked)
+		}
+		for index, option := range blocked {
+			if option.Action != test.blocked[index] || !errors.Is(option.Blocked, ErrNoOutcome) {
+				t.Errorf("test: %s \n unexpected blocked option %s: %v", test.note, option.Action, option.Blocked)
+			}
+		}
+	}
+
+	if _, _, err := flow.AvailableActions(&Butterfly{lifeStage: "larva"}); !errors.Is(err, ErrUnknownStatus) {
+		t.Errorf("expected %v, got %v", ErrUnknownStatus, err)
+	}
+}
+
+type traceKey struct{}
+
+// A Butterfly that lives in some slow store, and so cares about deadlines and trace IDs
+type TracedButterfly struct {
+	Butterfly
+	traces []string
+}
+
+func (bug *TracedButterfly) trace(ctx context.Context, call string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	bug.traces = append(bug.traces, fmt.Sprintf("%s:%v", call, ctx.Value(traceKey{})))
+	return nil
+}
+
+func (bug *TracedButterfly) GetStatusCtx(ctx context.Context) (string, error) {
+	if err := bug.trace(ctx, "GetStatus"); err != nil {
+		return INVALID, err
+	}
+	return bug.GetStatus()
+}
+
+func (bug *TracedButterfly) SetStatusCtx(ctx context.Context, status, action string) error {
+	if err := bug.trace(ctx, "SetStatus"); err != nil {
+		return err
+	}
+	return bug.SetStatus(status, action)
+}
+
+func (bug *TracedButterfly) GetContextCtx(ctx context.Context) (ValidationTable, error) {
+	if err := bug.trace(ctx, "GetContext"); err != nil {
+		return ValidationTable{}, err
+	}
+	return bug.GetContext()
+}
+
+func TestSafeTakeActionContext(t *testing.T) {
+	unfinished := NewFlow[*TracedButterfly]()
+	unfinished.Stages = buildGranularFlow().Stages
+	unfinished.Transitions = buildGranularFlow().Transitions
+	flow := unfinished.Finish()
+
+	hookTrace := ""
+	flow.AfterTransition(func(event TransitionEvent[*TracedButterfly]) {
+		hookTrace = fmt.Sprint(event.Context.Value(traceKey{}))
+	})
+
+	Tracy := TracedButterfly{Butterfly: Butterfly{color: "red", lifeStage: stageEgg}}
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+	change, err := flow.TakeActionContext(ctx, &Tracy, actionHatch)
+	if err != nil || change != stageCaterpillar {
+		t.Fatalf("Wanted %s, got %s, %v", stageCaterpillar, change, err)
+	}
+	want := []string{"GetStatus:trace-1", "GetContext:trace-1", "SetStatus:trace-1"}
+	if fmt.Sprint(Tracy.traces) != fmt.Sprint(want) {
+		t.Errorf("context was not passed to every asset call: %q", Tracy.traces)
+	}
+	if hookTrace != "trace-1" {
+		t.Errorf("context was not passed to hooks, got %q", hookTrace)
+	}
+
+	// a cancelled request never reaches SetStatus
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	change, err = flow.TakeActionContext(cancelled, &Tracy, actionGrow)
+	if !errors.Is(err, context.Canceled) || change != INVALID || Tracy.lifeStage != stageCaterpillar {
+		t.Errorf("expected the cancelled context to stop the transition, got %s, %v", change, err)
+	}
+}
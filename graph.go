@@ -0,0 +1,296 @@
+package flowchart
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrNoPath = errors.New("no path between stages")
+
+// PathStep is one action on the way from one stage to another
+type PathStep struct {
+	From   string
+	Action string
+	To     string
+}
+
+// flowEdge is one branch an asset in From can take, along with the branch itself
+type flowEdge struct {
+	PathStep
+	outcome Outcome
+}
+
+// flowEdges lists every branch an asset in each stage can take, following only the transitions the
+// stage (or one of its parents, unless it's terminal) actually allows, the way TakeAction does. A
+// stage's own branches come first, then its parents', then any branches with no origin, each in
+// transition name order with branches in the order they're tried.
+func (f Flow[Asset]) flowEdges() (map[string][]flowEdge, error) {
+	declared := map[string][]flowEdge{}
+	for _, name := range sortedKeys(f.transitions) {
+		outcomes, err := f.transitions[name].Outcomes()
+		if err != nil {
+			return nil, err
+		}
+		for _, outcome := range outcomes {
+			// branches with no origin apply from wherever the action is allowed, which is worked out below
+			if stage, OK := f.stages[outcome.Origin]; outcome.Origin != "" && (!OK || !contains(stage.Transitions, name)) {
+				continue
+			}
+			step := PathStep{From: outcome.Origin, Action: name, To: outcome.Destination}
+			declared[outcome.Origin] = append(declared[outcome.Origin], flowEdge{step, outcome})
+		}
+	}
+
+	edges := map[string][]flowEdge{}
+	for _, stage := range sortedKeys(f.stages) {
+		for _, level := range actionSources(f.stages, stage) {
+			for _, edge := range declared[level] {
+				edge.From = stage
+				edges[stage] = append(edges[stage], edge)
+			}
+		}
+		actions := stageActions(f.stages, stage)
+		for _, edge := range declared[""] {
+			if contains(actions, edge.Action) {
+				edge.From = stage
+				edges[stage] = append(edges[stage], edge)
+			}
+		}
+	}
+	return edges, nil
+}
+
+// graphEdges is flowEdges without the branches that lead to stages the flow doesn't have, so every
+// query below is deterministic and only ever names real stages
+func (f Flow[Asset]) graphEdges() (map[string][]PathStep, error) {
+	all, err := f.flowEdges()
+	if err != nil {
+		return nil, err
+	}
+	edges := map[string][]PathStep{}
+	for stage, stageEdges := range all {
+		for _, edge := range stageEdges {
+			if _, OK := f.stages[edge.To]; OK {
+				edges[stage] = append(edges[stage], edge.PathStep)
+			}
+		}
+	}
+	return edges, nil
+}
+
+// occupiable lists the stages an asset can actually be in, which leaves out composite stages
+func (f Flow[Asset]) occupiable() []string {
+	stages := []string{}
+	for _, name := range sortedKeys(f.stages) {
+		if !isComposite(f.stages, name) {
+			stages = append(stages, name)
+		}
+	}
+	return stages
+}
+
+// Reachable lists every stage an asset in from could end up in after one or more actions, sorted by name.
+// from is only included if some path leads back to it.
+func (f Flow[Asset]) Reachable(from string) ([]string, error) {
+	if _, OK := f.stages[from]; !OK {
+		return nil, &TransitionError{Status: from, Err: ErrUnknownStatus}
+	}
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+
+	visited := map[string]bool{}
+	queue := []string{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, edge := range edges[current] {
+			if !visited[edge.To] {
+				visited[edge.To] = true
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	return sortedKeys(visited), nil
+}
+
+// ShortestPath finds the fewest actions that could take an asset from one stage to another, assuming
+// the context lets it take whichever branch it needs. An empty path means from and to are the same stage.
+func (f Flow[Asset]) ShortestPath(from, to string) ([]PathStep, error) {
+	for _, name := range []string{from, to} {
+		if _, OK := f.stages[name]; !OK {
+			return nil, &TransitionError{Status: name, Err: ErrUnknownStatus}
+		}
+	}
+	if from == to {
+		return []PathStep{}, nil
+	}
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+
+	// remember how we first got to each stage, then walk back from the end
+	cameFrom := map[string]PathStep{}
+	visited := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 && !visited[to] {
+		current := queue[0]
+		queue = queue[1:]
+		for _, edge := range edges[current] {
+			if !visited[edge.To] {
+				visited[edge.To] = true
+				cameFrom[edge.To] = edge
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	if !visited[to] {
+		return nil, fmt.Errorf("%w: '%s' to '%s'", ErrNoPath, from, to)
+	}
+
+	path := []PathStep{}
+	for current := to; current != from; current = cameFrom[current].From {
+		path = append(path, cameFrom[current])
+	}
+	for ii, jj := 0, len(path)-1; ii < jj; ii, jj = ii+1, jj-1 {
+		path[ii], path[jj] = path[jj], path[ii]
+	}
+	return path, nil
+}
+
+// StronglyConnectedComponents groups the stages so that every stage in a group can reach every other.
+// Composite stages are left out, here and in Cycles, Sinks and Sources.
+// Each group is sorted by name, and the groups are sorted by their first stage.
+func (f Flow[Asset]) StronglyConnectedComponents() ([][]string, error) {
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tarjan's algorithm
+	index := map[string]int{}
+	lowLink := map[string]int{}
+	onStack := map[string]bool{}
+	stack := []string{}
+	components := [][]string{}
+
+	var connect func(stage string)
+	connect = func(stage string) {
+		index[stage] = len(index)
+		lowLink[stage] = index[stage]
+		stack = append(stack, stage)
+		onStack[stage] = true
+
+		for _, edge := range edges[stage] {
+			if _, seen := index[edge.To]; !seen {
+				connect(edge.To)
+				if lowLink[edge.To] < lowLink[stage] {
+					lowLink[stage] = lowLink[edge.To]
+				}
+			} else if onStack[edge.To] && index[edge.To] < lowLink[stage] {
+				lowLink[stage] = index[edge.To]
+			}
+		}
+
+		if lowLink[stage] == index[stage] {
+			component := []string{}
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == stage {
+					break
+				}
+			}
+			sort.Strings(component)
+			components = append(components, component)
+		}
+	}
+	for _, stage := range f.occupiable() {
+		if _, seen := index[stage]; !seen {
+			connect(stage)
+		}
+	}
+
+	sort.Slice(components, func(i, j int) bool {
+		return components[i][0] < components[j][0]
+	})
+	return components, nil
+}
+
+// Cycles lists the groups of stages an asset could go round and round in, including single stages
+// with an action that leads back to themselves
+func (f Flow[Asset]) Cycles() ([][]string, error) {
+	components, err := f.StronglyConnectedComponents()
+	if err != nil {
+		return nil, err
+	}
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+
+	cycles := [][]string{}
+	for _, component := range components {
+		if len(component) > 1 {
+			cycles = append(cycles, component)
+			continue
+		}
+		for _, edge := range edges[component[0]] {
+			if edge.To == component[0] {
+				cycles = append(cycles, component)
+				break
+			}
+		}
+	}
+	return cycles, nil
+}
+
+// Sinks lists the dead ends: stages with no way out to any other stage
+func (f Flow[Asset]) Sinks() ([]string, error) {
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+	sinks := []string{}
+	for _, stage := range f.occupiable() {
+		leaves := false
+		for _, edge := range edges[stage] {
+			if edge.To != stage {
+				leaves = true
+				break
+			}
+		}
+		if !leaves {
+			sinks = append(sinks, stage)
+		}
+	}
+	return sinks, nil
+}
+
+// Sources lists the stages no other stage leads to, which is where assets have to start
+func (f Flow[Asset]) Sources() ([]string, error) {
+	edges, err := f.graphEdges()
+	if err != nil {
+		return nil, err
+	}
+	entered := map[string]bool{}
+	for _, stageEdges := range edges {
+		for _, edge := range stageEdges {
+			if edge.To != edge.From {
+				entered[edge.To] = true
+			}
+		}
+	}
+	sources := []string{}
+	for _, stage := range f.occupiable() {
+		if !entered[stage] {
+			sources = append(sources, stage)
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,119 @@
+package flowchart
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSafeGraphQueries(t *testing.T) {
+	flow := generateSimpleFlow()
+
+	reachable, err := flow.Reachable(stageCaterpillar)
+	if err != nil || fmt.Sprint(reachable) != fmt.Sprint([]string{stageButterfly, stageCocoon, stageMoth}) {
+		t.Errorf("unexpected stages reachable from %s: %v, %v", stageCaterpillar, reachable, err)
+	}
+	if _, err := flow.Reachable("larva"); !errors.Is(err, ErrUnknownStatus) {
+		t.Errorf("expected %v for an unknown stage, got %v", ErrUnknownStatus, err)
+	}
+
+	path, err := flow.ShortestPath(stageEgg, stageMoth)
+	want := []PathStep{
+		{From: stageEgg, Action: actionAge, To: stageCaterpillar},
+		{From: stageCaterpillar, Action: actionAge, To: stageCocoon},
+		{From: stageCocoon, Action: actionAge, To: stageMoth},
+	}
+	if err != nil || fmt.Sprint(path) != fmt.Sprint(want) {
+		t.Errorf("expected the path %v, got %v, %v", want, path, err)
+	}
+	if path, err := flow.ShortestPath(stageEgg, stageEgg); err != nil || len(path) != 0 {
+		t.Errorf("expected an empty path to the same stage, got %v, %v", path, err)
+	}
+	if _, err := flow.ShortestPath(stageMoth, stageEgg); !errors.Is(err, ErrNoPath) {
+		t.Errorf("expected %v going backwards, got %v", ErrNoPath, err)
+	}
+
+	// eaten isn't a stage of this flow, so it doesn't count as a way out
+	sinks, err := flow.Sinks()
+	if err != nil || fmt.Sprint(sinks) != fmt.Sprint([]string{stageButterfly, stageMoth}) {
+		t.Errorf("unexpected sinks %v, %v", sinks, err)
+	}
+	sources, err := flow.Sources()
+	if err != nil || fmt.Sprint(sources) != fmt.Sprint([]string{stageEgg}) {
+		t.Errorf("unexpected sources %v, %v", sources, err)
+	}
+
+	// cocoons that need more time loop back on themselves
+	cycles, err := flow.Cycles()
+	if err != nil || fmt.Sprint(cycles) != fmt.Sprint([][]string{{stageCocoon}}) {
+		t.Errorf("unexpected cycles %v, %v", cycles, err)
+	}
+	components, err := flow.StronglyConnectedComponents()
+	if err != nil || len(components) != 5 {
+		t.Errorf("expected every stage on its own, got %v, %v", components, err)
+	}
+}
+
+func TestSafeGraphCycles(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	// some butterflies get a second go as caterpillars
+	butterfly := unfinished.Stages[stageButterfly]
+	regress := NewTransition("regress")
+	blank, _ := NewValidationTable()
+	regress.AddStage(&butterfly, blank, NewStage(stageCaterpillar))
+	unfinished.AddStages(butterfly)
+	unfinished.AddTransitions(regress)
+	flow := unfinished.Finish()
+
+	cycles, err := flow.Cycles()
+	want := [][]string{{stageButterfly, stageCaterpillar, stageCocoon}}
+	if err != nil || fmt.Sprint(cycles) != fmt.Sprint(want) {
+		t.Errorf("expected the cycle %v, got %v, %v", want, cycles, err)
+	}
+	components, _ := flow.StronglyConnectedComponents()
+	if len(components) != 3 {
+		t.Errorf("expected egg, moth and the loop, got %v", components)
+	}
+
+	path, err := flow.ShortestPath(stageButterfly, stageMoth)
+	if err != nil || len(path) != 3 || path[0].Action != "regress" {
+		t.Errorf("expected the way round through the caterpillar stage, got %v, %v", path, err)
+	}
+	if sinks, _ := flow.Sinks(); fmt.Sprint(sinks) != fmt.Sprint([]string{stageMoth}) {
+		t.Errorf("expected only moths to be stuck, got %v", sinks)
+	}
+}
+
+// buildOriginlessFlow has a single branch set straight on NextStages, with no origin, so it applies
+// from x, the only stage that lists its transition
+func buildOriginlessFlow() UnfinishedFlow[*Butterfly] {
+	x, y := NewStage("x"), NewStage("y")
+	x.Transitions = []string{"go"}
+	goTran := NewTransition("go")
+	goTran.NextStages[" "] = "y"
+	unfinished := NewFlow[*Butterfly]()
+	unfinished.AddStages(x, y)
+	unfinished.AddTransitions(goTran)
+	return unfinished
+}
+
+func TestSafeGraphOriginlessBranch(t *testing.T) {
+	flow := buildOriginlessFlow().Finish()
+	if destination, _, err := flow.PreviewAction(&Butterfly{lifeStage: "x"}, "go"); err != nil || destination != "y" {
+		t.Fatalf("expected the branch to take x to y, got %s, %v", destination, err)
+	}
+
+	// the graph follows the same branch TakeAction does
+	if reachable, err := flow.Reachable("x"); err != nil || fmt.Sprint(reachable) != "[y]" {
+		t.Errorf("expected y to be reachable from x, got %v, %v", reachable, err)
+	}
+	want := []PathStep{{From: "x", Action: "go", To: "y"}}
+	if path, err := flow.ShortestPath("x", "y"); err != nil || fmt.Sprint(path) != fmt.Sprint(want) {
+		t.Errorf("expected the path %v, got %v, %v", want, path, err)
+	}
+	sinks, _ := flow.Sinks()
+	sources, _ := flow.Sources()
+	if fmt.Sprint(sinks) != "[y]" || fmt.Sprint(sources) != "[x]" {
+		t.Errorf("expected x to lead to y, got sources %v and sinks %v", sources, sinks)
+	}
+}
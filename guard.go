@@ -0,0 +1,699 @@
+package flowchart
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type guardKind int
+
+const (
+	guardAlways guardKind = iota // the zero Guard, which every context meets
+	guardFlag
+	guardDontCare
+	guardNot
+	guardAll
+	guardAny
+	guardCompare
+	guardIn
+)
+
+var compareOperators = []string{"==", "!=", "<=", ">=", "<", ">"} // longest first, for the parser
+
+// Guard is a branch condition that can say more than a ValidationTable: OR, NOT, nested groups and
+// tags that are deliberately ignored. Like a table, a flag only matches when the context has that tag.
+//
+// The compact string form, which ParseGuard reads back, looks like
+//
+//	isFinishedMetamorphosing & (isBrown | isGrey) & !isGreen & isAdult?
+//
+// where "tag" requires tag:true, "!tag" requires tag:false, "!(...)" negates a group, and "tag?" marks a
+// tag that doesn't matter. & binds tighter than |. Tags with anything other than letters, digits, '_',
+// '-' or '.' in them are written as quoted Go strings.
+//
+// Guards can also compare the typed values added with ValidationTable.AddValue:
+//
+//	cocoonAge >= 3 & color in {brown, grey} & laidAt < "2026-01-01T00:00:00Z"
+//
+// Literals are numbers, quoted strings, or bare words (read as strings). A string literal compared
+// with a time.Time value is read as RFC 3339.
+type Guard struct {
+	kind     guardKind
+	tag      string
+	flag     bool
+	children []Guard
+
+	op     string        // for comparisons
+	values []interface{} // the literal(s) a value is compared with
+
+	err error // why Compare or In couldn't build the guard; see Err
+}
+
+// Condition is anything that can be used as a branch condition: a ValidationTable or a Guard
+type Condition interface {
+	condition() (ValidationTable, Guard)
+}
+
+func (vt ValidationTable) condition() (ValidationTable, Guard) {
+	return vt, Guard{}
+}
+
+func (g Guard) condition() (ValidationTable, Guard) {
+	table := ValidationTableFrom(nil)
+	return table, g
+}
+
+// tableAndGuard is a branch condition with both parts, as read back from a branch key
+type tableAndGuard struct {
+	table ValidationTable
+	guard Guard
+}
+
+func (c tableAndGuard) condition() (ValidationTable, Guard) {
+	return c.table, c.guard
+}
+
+func Flag(tag string, flag bool) Guard {
+	return Guard{kind: guardFlag, tag: tag, flag: flag}
+}
+
+// DontCare documents that a tag was considered and doesn't affect the branch; it always matches
+func DontCare(tag string) Guard {
+	return Guard{kind: guardDontCare, tag: tag}
+}
+
+// Compare checks a typed context value against a literal; op is one of == != < <= > >=.
+// A value that is missing, or of a type that can't be compared with the literal, never matches.
+// An unknown operator or unsupported literal gives a guard that never matches, and whose Err says why.
+func Compare(tag string, op string, value interface{}) Guard {
+	if !contains(compareOperators, op) {
+		return invalidGuard(fmt.Errorf("can't compare tag '%s': unknown operator %q", tag, op))
+	}
+	normalized, err := normalizeValue(value)
+	if err != nil {
+		return invalidGuard(fmt.Errorf("can't compare tag '%s': %w", tag, err))
+	}
+	return Guard{kind: guardCompare, tag: tag, op: op, values: []interface{}{normalized}}
+}
+
+// In checks that a typed context value equals one of the given literals. Like Compare, an unsupported
+// literal gives a guard that never matches, and whose Err says why.
+func In(tag string, values ...interface{}) Guard {
+	normalized := []interface{}{}
+	for _, value := range values {
+		value, err := normalizeValue(value)
+		if err != nil {
+			return invalidGuard(fmt.Errorf("can't check tag '%s' is in a set: %w", tag, err))
+		}
+		normalized = append(normalized, value)
+	}
+	return Guard{kind: guardIn, tag: tag, values: normalized}
+}
+
+// invalidGuard behaves, and prints, like AnyOf(), but remembers what went wrong
+func invalidGuard(err error) Guard {
+	return Guard{kind: guardAny, err: err}
+}
+
+// Err reports why a Compare or In anywhere in the guard couldn't be built. Adding a branch with such a
+// guard fails, so this only needs checking for guards that are evaluated directly.
+func (g Guard) Err() error {
+	var err error
+	g.walk(func(guard Guard) {
+		if err == nil {
+			err = guard.err
+		}
+	})
+	return err
+}
+
+func Not(guard Guard) Guard {
+	return Guard{kind: guardNot, children: []Guard{guard}}
+}
+
+func AllOf(guards ...Guard) Guard {
+	return Guard{kind: guardAll, children: guards}
+}
+
+func AnyOf(guards ...Guard) Guard {
+	return Guard{kind: guardAny, children: guards}
+}
+
+// GuardFromTable turns a table into the equivalent conjunction of flags
+func GuardFromTable(vt ValidationTable) Guard {
+	if len(vt.tags) == 0 {
+		return Guard{}
+	}
+	guards := []Guard{}
+	for _, tag := range vt.tags {
+		guards = append(guards, Flag(tag, vt.table[tag]))
+	}
+	if len(guards) == 1 {
+		return guards[0]
+	}
+	return AllOf(guards...)
+}
+
+// IsZero reports whether the guard is the zero Guard, which places no requirements at all
+func (g Guard) IsZero() bool {
+	return g.kind == guardAlways
+}
+
+// Evaluate reports whether a context meets the guard, the way meetsRequirementsOf does for tables
+func (g Guard) Evaluate(context ValidationTable) bool {
+	switch g.kind {
+	case guardFlag:
+		flag, exists := context.table[g.tag]
+		return exists && flag == g.flag
+	case guardNot:
+		return !g.children[0].Evaluate(context)
+	case guardAll:
+		for _, child := range g.children {
+			if !child.Evaluate(context) {
+				return false
+			}
+		}
+		return true
+	case guardAny:
+		for _, child := range g.children {
+			if child.Evaluate(context) {
+				return true
+			}
+		}
+		return false
+	case guardCompare:
+		value, exists := context.values[g.tag]
+		if !exists {
+			return false
+		}
+		order, OK := compareValues(value, g.values[0])
+		if !OK {
+			return false
+		}
+		switch g.op {
+		case "==":
+			return order == 0
+		case "!=":
+			return order != 0
+		case "<":
+			return order < 0
+		case "<=":
+			return order <= 0
+		case ">":
+			return order > 0
+		case ">=":
+			return order >= 0
+		}
+		return false
+	case guardIn:
+		value, exists := context.values[g.tag]
+		if !exists {
+			return false
+		}
+		for _, literal := range g.values {
+			if order, OK := compareValues(value, literal); OK && order == 0 {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func (g Guard) walk(visit func(Guard)) {
+	visit(g)
+	for _, child := range g.children {
+		child.walk(visit)
+	}
+}
+
+// flagTags lists the tags the guard checks as flags
+func (g Guard) flagTags() []string {
+	tags := []string{}
+	g.walk(func(guard Guard) {
+		if (guard.kind == guardFlag || guard.kind == guardDontCare) && !contains(tags, guard.tag) {
+			tags = append(tags, guard.tag)
+		}
+	})
+	return tags
+}
+
+// addRequiredFlags adds the flags any context meeting the guard must have: its own, if it's a flag,
+// or those of every part of an AllOf. It's not OK if one of them is already required the other way.
+func (g Guard) addRequiredFlags(required *ValidationTable) bool {
+	switch g.kind {
+	case guardFlag:
+		if flag, exists := required.Get(g.tag); exists && flag != g.flag {
+			return false
+		}
+		required.AddFlag(g.tag, g.flag)
+	case guardAll:
+		for _, child := range g.children {
+			if !child.addRequiredFlags(required) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// valueLiterals maps every typed value the guard compares to the literals it's compared with
+func (g Guard) valueLiterals() map[string][]interface{} {
+	literals := map[string][]interface{}{}
+	g.walk(func(guard Guard) {
+		if guard.kind == guardCompare || guard.kind == guardIn {
+			literals[guard.tag] = append(literals[guard.tag], guard.values...)
+		}
+	})
+	return literals
+}
+
+// sampleValues picks a value at, and one strictly between or beyond, every literal, so that every
+// comparison against those literals sees every outcome it can have
+func sampleValues(literals []interface{}) []interface{} {
+	numbers, texts, times := []float64{}, []string{}, []time.Time{}
+	for _, literal := range literals {
+		switch typed := literal.(type) {
+		case int64:
+			numbers = append(numbers, float64(typed))
+		case float64:
+			numbers = append(numbers, typed)
+		case string:
+			texts = append(texts, typed)
+			if parsed, err := time.Parse(time.RFC3339Nano, typed); err == nil {
+				times = append(times, parsed)
+			}
+		case time.Time:
+			times = append(times, typed)
+		}
+	}
+
+	samples := []interface{}{}
+	sort.Float64s(numbers)
+	for index, number := range numbers {
+		samples = append(samples, number, number+1)
+		if index == 0 {
+			samples = append(samples, number-1)
+		} else {
+			samples = append(samples, (numbers[index-1]+number)/2)
+		}
+	}
+	if len(texts) > 0 {
+		samples = append(samples, "")
+	}
+	for _, text := range texts {
+		samples = append(samples, text, text+"\x00")
+	}
+	for _, moment := range times {
+		samples = append(samples, moment, moment.Add(-time.Nanosecond), moment.Add(time.Nanosecond))
+	}
+	return samples
+}
+
+// compareValues orders a context value against a guard literal, returning false if they can't be compared.
+// Both have already been through normalizeValue.
+func compareValues(value, literal interface{}) (int, bool) {
+	switch typed := value.(type) {
+	case int64:
+		switch lit := literal.(type) {
+		case int64:
+			return compareOrdered(typed, lit), true
+		case float64:
+			return compareOrdered(float64(typed), lit), true
+		}
+	case float64:
+		switch lit := literal.(type) {
+		case int64:
+			return compareOrdered(typed, float64(lit)), true
+		case float64:
+			return compareOrdered(typed, lit), true
+		}
+	case string:
+		if lit, OK := literal.(string); OK {
+			return strings.Compare(typed, lit), true
+		}
+	case time.Time:
+		lit, OK := literal.(time.Time)
+		if text, isText := literal.(string); isText {
+			parsed, err := time.Parse(time.RFC3339Nano, text)
+			lit, OK = parsed, err == nil
+		}
+		switch {
+		case !OK:
+		case typed.Before(lit):
+			return -1, true
+		case typed.After(lit):
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Tags lists every tag the guard mentions, in the order they appear
+func (g Guard) Tags() []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	var walk func(Guard)
+	walk = func(guard Guard) {
+		if guard.tag != "" && !seen[guard.tag] {
+			seen[guard.tag] = true
+			tags = append(tags, guard.tag)
+		}
+		for _, child := range guard.children {
+			walk(child)
+		}
+	}
+	walk(g)
+	return tags
+}
+
+func (g Guard) String() string {
+	switch g.kind {
+	case guardFlag:
+		if g.flag {
+			return guardTag(g.tag)
+		}
+		return "!" + guardTag(g.tag)
+	case guardDontCare:
+		return guardTag(g.tag) + "?"
+	case guardNot:
+		return "!(" + g.children[0].String() + ")"
+	case guardCompare:
+		return fmt.Sprintf("%s %s %s", guardTag(g.tag), g.op, guardLiteral(g.values[0]))
+	case guardIn:
+		literals := []string{}
+		for _, value := range g.values {
+			literals = append(literals, guardLiteral(value))
+		}
+		return fmt.Sprintf("%s in {%s}", guardTag(g.tag), strings.Join(literals, ", "))
+	case guardAll, guardAny:
+		if len(g.children) == 0 {
+			// an empty AllOf always matches and an empty AnyOf never does
+			if g.kind == guardAll {
+				return "()"
+			}
+			return "!()"
+		}
+		separator := " & "
+		if g.kind == guardAny {
+			separator = " | "
+		}
+		parts := []string{}
+		for _, child := range g.children {
+			part := child.String()
+			if child.kind == guardAny || (child.kind == guardAll && g.kind == guardAny) {
+				part = "(" + part + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, separator)
+	default:
+		return ""
+	}
+}
+
+var bareGuardTag = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+func guardTag(tag string) string {
+	if bareGuardTag.MatchString(tag) {
+		return tag
+	}
+	return strconv.Quote(tag)
+}
+
+var (
+	numericGuardLiteral = regexp.MustCompile(`^-?[0-9]`)
+	guardLiteralChars   = regexp.MustCompile(`^[A-Za-z0-9_.+\-]$`)
+)
+
+func guardLiteral(value interface{}) string {
+	switch typed := value.(type) {
+	case int64:
+		return strconv.FormatInt(typed, 10)
+	case float64:
+		text := strconv.FormatFloat(typed, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0" // keep it a float when read back
+		}
+		return text
+	case time.Time:
+		return strconv.Quote(typed.Format(time.RFC3339Nano))
+	case string:
+		if bareGuardTag.MatchString(typed) && !numericGuardLiteral.MatchString(typed) && typed != "in" {
+			return typed
+		}
+		return strconv.Quote(typed)
+	default:
+		return strconv.Quote(fmt.Sprint(typed))
+	}
+}
+
+// ParseGuard reads the compact form written by Guard.String
+func ParseGuard(text string) (Guard, error) {
+	parser := guardParser{text: text}
+	parser.skipSpace()
+	if parser.done() {
+		return Guard{}, nil
+	}
+	guard, err := parser.parseAny()
+	if err != nil {
+		return Guard{}, err
+	}
+	parser.skipSpace()
+	if !parser.done() {
+		return Guard{}, parser.errorf("unexpected %q", parser.text[parser.pos:])
+	}
+	return guard, nil
+}
+
+type guardParser struct {
+	text string
+	pos  int
+}
+
+func (p *guardParser) done() bool {
+	return p.pos >= len(p.text)
+}
+
+func (p *guardParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *guardParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *guardParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bad guard %q at %d: %s", p.text, p.pos, fmt.Sprintf(format, args...))
+}
+
+// parseAny reads terms separated by |
+func (p *guardParser) parseAny() (Guard, error) {
+	first, err := p.parseAll()
+	if err != nil {
+		return Guard{}, err
+	}
+	guards := []Guard{first}
+	for p.skipSpace(); p.peek() == '|'; p.skipSpace() {
+		p.pos++
+		next, err := p.parseAll()
+		if err != nil {
+			return Guard{}, err
+		}
+		guards = append(guards, next)
+	}
+	if len(guards) == 1 {
+		return first, nil
+	}
+	return AnyOf(guards...), nil
+}
+
+// parseAll reads terms separated by &
+func (p *guardParser) parseAll() (Guard, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return Guard{}, err
+	}
+	guards := []Guard{first}
+	for p.skipSpace(); p.peek() == '&'; p.skipSpace() {
+		p.pos++
+		next, err := p.parseUnary()
+		if err != nil {
+			return Guard{}, err
+		}
+		guards = append(guards, next)
+	}
+	if len(guards) == 1 {
+		return first, nil
+	}
+	return AllOf(guards...), nil
+}
+
+func (p *guardParser) parseUnary() (Guard, error) {
+	p.skipSpace()
+	switch p.peek() {
+	case '!':
+		p.pos++
+		p.skipSpace()
+		if p.peek() == '(' {
+			group, err := p.parseGroup()
+			if err != nil {
+				return Guard{}, err
+			}
+			if group.kind == guardAll && len(group.children) == 0 {
+				return AnyOf(), nil
+			}
+			return Not(group), nil
+		}
+		tag, err := p.parseTag()
+		if err != nil {
+			return Guard{}, err
+		}
+		return Flag(tag, false), nil
+	case '(':
+		return p.parseGroup()
+	default:
+		tag, err := p.parseTag()
+		if err != nil {
+			return Guard{}, err
+		}
+		if p.peek() == '?' {
+			p.pos++
+			return DontCare(tag), nil
+		}
+		return p.parseComparison(tag)
+	}
+}
+
+func (p *guardParser) parseGroup() (Guard, error) {
+	p.pos++ // opening paren
+	p.skipSpace()
+	if p.peek() == ')' {
+		p.pos++
+		return AllOf(), nil
+	}
+	group, err := p.parseAny()
+	if err != nil {
+		return Guard{}, err
+	}
+	p.skipSpace()
+	if p.peek() != ')' {
+		return Guard{}, p.errorf("expected ')'")
+	}
+	p.pos++
+	return group, nil
+}
+
+func (p *guardParser) parseTag() (string, error) {
+	p.skipSpace()
+	if p.peek() == '"' {
+		quoted, err := strconv.QuotedPrefix(p.text[p.pos:])
+		if err != nil {
+			return "", p.errorf("bad quoted tag")
+		}
+		p.pos += len(quoted)
+		tag, _ := strconv.Unquote(quoted)
+		return tag, nil
+	}
+	start := p.pos
+	for !p.done() && bareGuardTag.MatchString(p.text[p.pos:p.pos+1]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a tag")
+	}
+	return p.text[start:p.pos], nil
+}
+
+// parseComparison reads whatever follows a tag: an operator and literal, "in" and a set, or nothing for a flag
+func (p *guardParser) parseComparison(tag string) (Guard, error) {
+	p.skipSpace()
+	rest := p.text[p.pos:]
+	for _, op := range compareOperators {
+		if strings.HasPrefix(rest, op) {
+			p.pos += len(op)
+			literal, err := p.parseLiteral()
+			if err != nil {
+				return Guard{}, err
+			}
+			return Guard{kind: guardCompare, tag: tag, op: op, values: []interface{}{literal}}, nil
+		}
+	}
+
+	if strings.HasPrefix(rest, "in") && len(rest) > 2 && (rest[2] == '{' || unicode.IsSpace(rune(rest[2]))) {
+		p.pos += 2
+		p.skipSpace()
+		if p.peek() != '{' {
+			return Guard{}, p.errorf("expected '{'")
+		}
+		p.pos++
+		values := []interface{}{}
+		for p.skipSpace(); p.peek() != '}'; p.skipSpace() {
+			if len(values) > 0 {
+				if p.peek() != ',' {
+					return Guard{}, p.errorf("expected ',' or '}'")
+				}
+				p.pos++
+			}
+			literal, err := p.parseLiteral()
+			if err != nil {
+				return Guard{}, err
+			}
+			values = append(values, literal)
+		}
+		p.pos++
+		return Guard{kind: guardIn, tag: tag, values: values}, nil
+	}
+
+	return Flag(tag, true), nil
+}
+
+func (p *guardParser) parseLiteral() (interface{}, error) {
+	p.skipSpace()
+	if p.peek() == '"' {
+		return p.parseTag()
+	}
+	start := p.pos
+	for !p.done() && guardLiteralChars.MatchString(p.text[p.pos:p.pos+1]) {
+		p.pos++
+	}
+	word := p.text[start:p.pos]
+	switch {
+	case word == "":
+		return nil, p.errorf("expected a value")
+	case !numericGuardLiteral.MatchString(word):
+		return word, nil
+	}
+	if number, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return number, nil
+	}
+	number, err := strconv.ParseFloat(word, 64)
+	if err != nil {
+		return nil, p.errorf("bad number %q", word)
+	}
+	return number, nil
+}
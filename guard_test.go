@@ -0,0 +1,328 @@
+package flowchart
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeGuardEvaluate(t *testing.T) {
+	context, _ := NewValidationTable("isBrown", false, "isGrey", true, "isGreen", false)
+
+	type guardTest struct {
+		note  string
+		guard Guard
+		want  bool
+	}
+	guardTests := []guardTest{
+		{note: "zero guard", guard: Guard{}, want: true},
+		{note: "single flag", guard: Flag("isGrey", true), want: true},
+		{note: "wrong flag", guard: Flag("isBrown", true), want: false},
+		{note: "missing flag", guard: Flag("isAdult", false), want: false},
+		{note: "or", guard: AnyOf(Flag("isBrown", true), Flag("isGrey", true)), want: true},
+		{note: "and", guard: AllOf(Flag("isBrown", true), Flag("isGrey", true)), want: false},
+		{note: "not", guard: Not(Flag("isGreen", true)), want: true},
+		{note: "not a missing flag", guard: Not(Flag("isAdult", true)), want: true},
+		{note: "dont care", guard: AllOf(Flag("isGrey", true), DontCare("isAdult")), want: true},
+		{
+			note:  "nested",
+			guard: AllOf(Not(Flag("isGreen", true)), AnyOf(Flag("isBrown", true), AllOf(Flag("isGrey", true), Flag("isBrown", false)))),
+			want:  true,
+		},
+		{note: "empty any", guard: AnyOf(), want: false},
+		{note: "empty all", guard: AllOf(), want: true},
+	}
+
+	for _, test := range guardTests {
+		if test.guard.Evaluate(context) != test.want {
+			t.Errorf("test: %s \n expected %t for %s", test.note, test.want, test.guard)
+		}
+
+		// the compact form reads back to something that behaves the same and prints the same
+		parsed, err := ParseGuard(test.guard.String())
+		if err != nil {
+			t.Errorf("test: %s \n %v", test.note, err)
+			continue
+		}
+		if parsed.Evaluate(context) != test.want || parsed.String() != test.guard.String() {
+			t.Errorf("test: %s \n %s read back as %s", test.note, test.guard, parsed)
+		}
+	}
+}
+
+func TestSafeGuardParse(t *testing.T) {
+	guard, err := ParseGuard(`isFinished & (isBrown | isGrey) & !isGreen & isAdult? & "region:eu"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `isFinished & (isBrown | isGrey) & !isGreen & isAdult? & "region:eu"`; guard.String() != want {
+		t.Errorf("expected %s, got %s", want, guard)
+	}
+	if tags := guard.Tags(); len(tags) != 6 {
+		t.Errorf("expected six tags, got %v", tags)
+	}
+
+	for _, bad := range []string{"isBrown &", "(isBrown", "isBrown)", "| isBrown", `"unterminated`, "!"} {
+		if _, err := ParseGuard(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestSafeGuardBranches(t *testing.T) {
+	cocoonStage := NewStage(stageCocoon)
+	butterflyStage := NewStage(stageButterfly)
+	mothStage := NewStage(stageMoth)
+
+	// brown or green bugs become moths, without writing the branch out twice
+	mothGuard := AnyOf(Flag("isBrown", true), Flag("isGreen", true))
+	butterflyGuard := Not(mothGuard)
+	emergeTran := NewTransition(actionEmerge)
+	if err := emergeTran.AddStage(&cocoonStage, mothGuard, mothStage, butterflyGuard, butterflyStage); err != nil {
+		t.Fatal(err)
+	}
+
+	unfinished := NewFlow[*Butterfly]()
+	unfinished.AddStages(cocoonStage, butterflyStage, mothStage)
+	unfinished.AddTransitions(emergeTran)
+	flow, err := unfinished.FinishValidated(stageCocoon)
+	if err != nil {
+		t.Fatalf("a guard and its negation should not overlap: %v", err)
+	}
+
+	for color, want := range map[string]string{"brown": stageMoth, "green": stageMoth, "yellow": stageButterfly} {
+		bug := Butterfly{color: color, lifeStage: stageCocoon}
+		explanations, _ := flow.ExplainAction(&bug, actionEmerge)
+		change, err := flow.TakeAction(&bug, actionEmerge)
+		if err != nil || change != want {
+			t.Errorf("%s bug: wanted %s, got %s, %v", color, want, change, err)
+		}
+		for _, explanation := range explanations {
+			if explanation.Matches() != (explanation.Destination == want) {
+				t.Errorf("%s bug: wrong explanation for the %s branch", color, explanation.Destination)
+			}
+		}
+	}
+
+	// guards survive serialization
+	data, err := json.Marshal(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := Flow[*Butterfly]{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := json.Marshal(loaded)
+	if string(data) != string(again) {
+		t.Errorf("round trip changed the flow:\n%s\n%s", data, again)
+	}
+
+	// overlapping guards are still caught
+	looseTran := NewTransition(actionEmerge)
+	looseTran.AddStage(&cocoonStage, mothGuard, mothStage, Flag("isGreen", false), butterflyStage)
+	if overlaps, _ := looseTran.Overlaps(); len(overlaps) != 1 {
+		t.Errorf("expected the guards to overlap, got %v", overlaps)
+	}
+}
+
+func TestSafeGuardComparisons(t *testing.T) {
+	laidAt := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	context, _ := NewValidationTable()
+	context.AddValue("cocoonAge", 3)
+	context.AddValue("wingspan", 4.5)
+	context.AddValue("color", "grey")
+	context.AddValue("laidAt", laidAt)
+	if err := context.AddValue("spots", []int{1, 2}); err == nil {
+		t.Errorf("expected an error adding an unsupported value type")
+	}
+
+	type compareTest struct {
+		note  string
+		guard Guard
+		want  bool
+	}
+	compareTests := []compareTest{
+		{note: "int threshold", guard: Compare("cocoonAge", ">=", 3), want: true},
+		{note: "int below threshold", guard: Compare("cocoonAge", ">", 3), want: false},
+		{note: "int against float", guard: Compare("cocoonAge", "<", 3.5), want: true},
+		{note: "float", guard: Compare("wingspan", "==", 4.5), want: true},
+		{note: "string", guard: Compare("color", "!=", "brown"), want: true},
+		{note: "string set", guard: In("color", "brown", "grey"), want: true},
+		{note: "string not in set", guard: In("color", "brown", "green"), want: false},
+		{note: "time", guard: Compare("laidAt", "<", laidAt.Add(time.Hour)), want: true},
+		{note: "missing value", guard: Compare("age", ">=", 0), want: false},
+		{note: "mismatched types", guard: Compare("color", ">", 3), want: false},
+		{note: "unknown operator", guard: Compare("cocoonAge", "~", 3), want: false},
+		{note: "mixed", guard: AllOf(Compare("cocoonAge", ">=", 3), Not(In("color", "green", "yellow"))), want: true},
+	}
+	for _, test := range compareTests {
+		if test.guard.Evaluate(context) != test.want {
+			t.Errorf("test: %s \n expected %t for %s", test.note, test.want, test.guard)
+		}
+		parsed, err := ParseGuard(test.guard.String())
+		if err != nil {
+			t.Errorf("test: %s \n %v", test.note, err)
+			continue
+		}
+		if parsed.Evaluate(context) != test.want || parsed.String() != test.guard.String() {
+			t.Errorf("test: %s \n %s read back as %s", test.note, test.guard, parsed)
+		}
+	}
+
+	guard, err := ParseGuard(`cocoonAge >= 3 & color in {brown, "dark grey"} & laidAt < "2026-05-01T00:00:00Z" & wingspan > 1e+00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context.AddValue("color", "dark grey")
+	if !guard.Evaluate(context) {
+		t.Errorf("expected %s to match", guard)
+	}
+}
+
+func TestSafeGuardBadComparisons(t *testing.T) {
+	for note, guard := range map[string]Guard{
+		"unknown operator":    Compare("cocoonAge", "~", 3),
+		"unsupported literal": Compare("spots", "==", []int{1, 2}),
+		"bad set member":      In("color", "brown", struct{}{}),
+		"nested":              AllOf(Flag("isBrown", true), Not(In("color", nil))),
+	} {
+		if guard.Err() == nil {
+			t.Errorf("test: %s \n expected %s to say what's wrong with it", note, guard)
+		}
+	}
+	if err := AllOf(Compare("cocoonAge", ">=", 3), In("color", "brown")).Err(); err != nil {
+		t.Errorf("expected good comparisons to have no error, got %v", err)
+	}
+
+	// a bad guard can't quietly become a branch that never matches
+	cocoonStage := NewStage(stageCocoon)
+	ageTran := NewTransition(actionAge)
+	err := ageTran.AddBranches(&cocoonStage,
+		Branch{If: Compare("cocoonAge", ">=", 3), To: NewStage(stageButterfly)},
+		Branch{If: Compare("cocoonAge", "=<", 3), To: NewStage(stageCocoon)},
+	)
+	if err == nil || len(ageTran.NextStages) != 0 {
+		t.Errorf("expected the bad guard to be refused, got %v and %v", err, ageTran.NextStages)
+	}
+	if err := ageTran.AddStage(&cocoonStage, In("cocoonAge", 3.5, []int{}), NewStage(stageCocoon)); err == nil {
+		t.Errorf("expected AddStage to refuse the bad guard")
+	}
+}
+
+func TestSafeGuardThresholdFlow(t *testing.T) {
+	// the cocoon threshold lives in the flow instead of in GetContext
+	eggStage := NewStage(stageEgg)
+	cocoonStage := NewStage(stageCocoon)
+	butterflyStage := NewStage(stageButterfly)
+	mothStage := NewStage(stageMoth)
+
+	ageTran := NewTransition(actionAge)
+	blankTable, _ := NewValidationTable()
+	ageTran.AddStage(&eggStage, blankTable, cocoonStage)
+	ageTran.AddStage(&cocoonStage,
+		AllOf(Compare("cocoonAge", ">=", 3), In("color", "brown", "grey")), mothStage,
+		Compare("cocoonAge", ">=", 3), butterflyStage,
+		Compare("cocoonAge", "<", 3), cocoonStage,
+	)
+
+	unfinished := NewFlow[*Butterfly]()
+	unfinished.AddStages(eggStage, cocoonStage, butterflyStage, mothStage)
+	unfinished.AddTransitions(ageTran)
+
+	// an old brown cocoon matches both of the first two branches
+	if err := unfinished.Overlaps(); err == nil || !err.(StructureErrors).Has(OverlappingBranches) {
+		t.Errorf("expected the moth and butterfly branches to overlap, got %v", err)
+	}
+	ageTran.MostSpecificWins = true
+	unfinished.Transitions[actionAge] = ageTran
+	if err := unfinished.Overlaps(); err != nil {
+		t.Errorf("expected the most specific branch to settle it, got %v", err)
+	}
+	flow, err := unfinished.FinishValidated(stageEgg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generateThresholdFlow := func() Flow[*Butterfly] { return flow }
+
+	slowPath := []butterflyTest{
+		{action: actionAge, result: stageCocoon},
+		{action: actionAge, result: stageCocoon},
+		{action: actionAge, result: stageCocoon},
+		{action: actionAge, result: stageCocoon},
+		{action: actionAge, result: stageMoth},
+	}
+	runButterflyTests(&Butterfly{color: "grey", lifeStage: stageEgg}, slowPath, generateThresholdFlow, t)
+
+	slowPath[len(slowPath)-1].result = stageButterfly
+	runButterflyTests(&Butterfly{color: "yellow", lifeStage: stageEgg}, slowPath, generateThresholdFlow, t)
+}
+
+func FuzzGuardParse(f *testing.F) {
+	f.Add(`isFinished & (isBrown | isGrey) & !isGreen & isAdult?`)
+	f.Add(`cocoonAge >= 3 & color in {brown, "dark grey"}`)
+	f.Add(`!(!())`)
+	f.Add(`"region:eu" | x < -1.5e+3`)
+	f.Fuzz(func(t *testing.T, text string) {
+		guard, err := ParseGuard(text)
+		if err != nil {
+			return
+		}
+		// once printed, a guard reads back to exactly the same thing
+		printed := guard.String()
+		again, err := ParseGuard(printed)
+		if err != nil {
+			t.Fatalf("%q printed as %q, which doesn't parse: %v", text, printed, err)
+		}
+		if again.String() != printed {
+			t.Fatalf("%q printed as %q, then %q", text, printed, again.String())
+		}
+	})
+}
+
+func TestSafeGuardOverlapsWithManyTags(t *testing.T) {
+	cocoonStage := NewStage(stageCocoon)
+	anyOf := func(tags ...string) Guard {
+		guards := []Guard{}
+		for _, tag := range tags {
+			guards = append(guards, Flag(tag, true))
+		}
+		return AnyOf(guards...)
+	}
+	first := strings.Split("a b c d e f g h i j k", " ")
+	second := strings.Split("l m n o p q r s t u v", " ")
+
+	// far too many tags to try every context, but the colors can never agree
+	emergeTran := NewTransition(actionEmerge)
+	emergeTran.AddStage(&cocoonStage,
+		AllOf(Flag("isBrown", true), anyOf(first...)), NewStage(stageMoth),
+		AllOf(Flag("isBrown", false), anyOf(second...)), NewStage(stageButterfly),
+	)
+	unfinished := NewFlow[*Butterfly]()
+	unfinished.AddStages(cocoonStage, NewStage(stageMoth), NewStage(stageButterfly))
+	unfinished.AddTransitions(emergeTran)
+	if err := unfinished.Overlaps(); err != nil {
+		t.Errorf("expected contradictory colors to rule out an overlap, got %v", err)
+	}
+
+	// without the colors it can't be settled either way, which isn't the same as an overlap
+	emergeTran = NewTransition(actionEmerge)
+	emergeTran.AddStage(&cocoonStage, anyOf(first...), NewStage(stageMoth), anyOf(second...), NewStage(stageButterfly))
+	unfinished.Transitions[actionEmerge] = emergeTran
+	err := unfinished.Overlaps()
+	var structErrs StructureErrors
+	if !errors.As(err, &structErrs) || !structErrs.Has(UncheckedBranches) || structErrs.Has(OverlappingBranches) {
+		t.Errorf("expected the branches to be reported as unchecked, got %v", err)
+	}
+
+	// the guards are part of what's reported
+	emergeTran = NewTransition(actionEmerge)
+	emergeTran.AddStage(&cocoonStage, Flag("isBrown", true), NewStage(stageMoth), Flag("isGreen", false), NewStage(stageButterfly))
+	unfinished.Transitions[actionEmerge] = emergeTran
+	err = unfinished.Overlaps()
+	if !errors.As(err, &structErrs) || len(structErrs) != 1 || !strings.Contains(string(structErrs[0].Branches[0]), "&isBrown") {
+		t.Errorf("expected the overlap to name the guards, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package flowchart
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Identifiable assets are recorded in history under their own ID. Anything else is recorded under
+// its type and address, which is only good for as long as the asset stays in memory.
+type Identifiable interface {
+	FlowID() string
+}
+
+// HistoryEntry is one call to TakeAction, successful or not. Fields are filled in as far as the
+// attempt got: Origin and Context once the asset's status was read, Branch once one matched.
+type HistoryEntry struct {
+	AssetID     string
+	Actor       Actor
+	Origin      string
+	Action      string
+	Destination string // INVALID when the attempt failed
+	Context     ValidationTable
+	Branch      *Outcome
+	Time        time.Time
+	Err         error
+}
+
+func (e HistoryEntry) Succeeded() bool {
+	return e.Err == nil
+}
+
+// HistoryStore keeps a record of every TakeAction attempt. History lists an asset's entries oldest first.
+type HistoryStore interface {
+	Record(ctx context.Context, entry HistoryEntry) error
+	History(ctx context.Context, assetID string) ([]HistoryEntry, error)
+}
+
+// SetHistoryStore starts recording every TakeAction attempt to store; pass nil to stop.
+// Like hooks, it applies to every copy of the flow.
+func (f *Flow[Asset]) SetHistoryStore(store HistoryStore) {
+	f.configure(func(settings *flowSettings) { settings.history = store })
+}
+
+// History lists every recorded attempt to move the asset, oldest first
+func (f Flow[Asset]) History(ctx context.Context, asset Asset) ([]HistoryEntry, error) {
+	history := f.settings().history
+	if history == nil {
+		return nil, fmt.Errorf("this flow has no history store")
+	}
+	return history.History(ctx, assetID(asset))
+}
+
+// recordHistory writes the finished entry, if there's a store. A transition that happened is never
+// undone because it couldn't be recorded; instead the destination comes back with ErrHistoryNotRecorded.
+func (settings flowSettings) recordHistory(ctx context.Context, entry HistoryEntry, destination string, err error) error {
+	if settings.history == nil {
+		return err
+	}
+	entry.Destination, entry.Err = destination, err
+	if recordErr := settings.history.Record(ctx, entry); recordErr != nil && err == nil {
+		return fmt.Errorf("%w: %v", ErrHistoryNotRecorded, recordErr)
+	}
+	return err
+}
+
+func assetID(asset interface{}) string {
+	if identifiable, OK := asset.(Identifiable); OK {
+		return identifiable.FlowID()
+	}
+	if isPointer(asset) {
+		return fmt.Sprintf("%T@%p", asset, asset)
+	}
+	return fmt.Sprintf("%T", asset)
+}
+
+// MemoryHistory is a HistoryStore that keeps everything in memory; it is safe for concurrent use
+type MemoryHistory struct {
+	mutex   sync.RWMutex
+	entries map[string][]HistoryEntry
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{
+		entries: map[string][]HistoryEntry{},
+	}
+}
+
+func (h *MemoryHistory) Record(_ context.Context, entry HistoryEntry) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries[entry.AssetID] = append(h.entries[entry.AssetID], entry)
+	return nil
+}
+
+func (h *MemoryHistory) History(_ context.Context, assetID string) ([]HistoryEntry, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return append([]HistoryEntry{}, h.entries[assetID]...), nil
+}
+
+// Assets lists the ID of every asset with at least one entry
+func (h *MemoryHistory) Assets() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return sortedKeys(h.entries)
+}
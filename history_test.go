@@ -0,0 +1,73 @@
+package flowchart
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type brokenHistory struct{}
+
+func (brokenHistory) Record(context.Context, HistoryEntry) error {
+	return errors.New("disk full")
+}
+
+func (brokenHistory) History(context.Context, string) ([]HistoryEntry, error) {
+	return nil, nil
+}
+
+func TestSafeTransitionHistory(t *testing.T) {
+	flow := generateSimpleFlow()
+	ctx := context.Background()
+	if _, err := flow.History(ctx, &Butterfly{}); err == nil {
+		t.Errorf("expected an error asking for history without a store")
+	}
+
+	store := NewMemoryHistory()
+	flow.SetHistoryStore(store)
+
+	Harriet := Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 1}
+	Henry := Butterfly{color: "green", lifeStage: stageEgg}
+	flow.TakeAction(&Harriet, actionSeen) // cocoons can't be seen
+	flow.TakeAction(&Harriet, actionAge)
+	flow.TakeAction(&Henry, actionAge)
+
+	entries, err := flow.History(ctx, &Harriet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected two entries for Harriet, got %v", entries)
+	}
+
+	failed, moved := entries[0], entries[1]
+	if failed.Succeeded() || !errors.Is(failed.Err, ErrActionNotAllowed) || failed.Destination != INVALID {
+		t.Errorf("expected the first attempt to be recorded as not allowed, got %+v", failed)
+	}
+	if failed.Origin != stageCocoon || failed.Action != actionSeen || failed.Branch != nil {
+		t.Errorf("unexpected failed entry %+v", failed)
+	}
+	if !moved.Succeeded() || moved.Origin != stageCocoon || moved.Destination != stageMoth {
+		t.Errorf("expected the second attempt to move Harriet to %s, got %+v", stageMoth, moved)
+	}
+	if moved.Branch == nil || moved.Branch.Destination != stageMoth {
+		t.Errorf("expected the matched branch on the entry, got %v", moved.Branch)
+	}
+	if flag, _ := moved.Context.Get("isBrown"); !flag {
+		t.Errorf("expected the evaluated context on the entry, got %s", moved.Context)
+	}
+	if moved.Time.IsZero() || moved.Time.Before(failed.Time) {
+		t.Errorf("entries should be timestamped in order")
+	}
+
+	if len(store.Assets()) != 2 {
+		t.Errorf("expected history for two assets, got %v", store.Assets())
+	}
+
+	// a store that can't keep up doesn't undo the transition, but does say so
+	flow.SetHistoryStore(brokenHistory{})
+	change, err := flow.TakeAction(&Henry, actionAge)
+	if change != stageCocoon || Henry.lifeStage != stageCocoon || !errors.Is(err, ErrHistoryNotRecorded) {
+		t.Errorf("expected the move to %s with %v, got %s, %v", stageCocoon, ErrHistoryNotRecorded, change, err)
+	}
+}
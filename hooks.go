@@ -0,0 +1,170 @@
+package flowchart
+
+import (
+	"context"
+	"sync"
+)
+
+// TransitionEvent is what hooks are told about a transition that is about to happen, or just did
+type TransitionEvent[Asset Flowable] struct {
+	Context     context.Context // the context given to TakeActionContext, or context.Background()
+	Actor       Actor           // the zero Actor unless the action was taken with TakeActionAs
+	Asset       Asset
+	Action      string
+	Origin      string
+	Destination string
+}
+
+// BeforeHook runs once the destination is known but before SetStatus; returning an error vetoes the transition
+type BeforeHook[Asset Flowable] func(event TransitionEvent[Asset]) error
+
+// AfterHook runs once SetStatus has succeeded
+type AfterHook[Asset Flowable] func(event TransitionEvent[Asset])
+
+// flowRegistry holds everything that can be added to a flow after Finish. It's safe to register with,
+// and change settings in, while other goroutines are taking actions.
+type flowRegistry[Asset Flowable] struct {
+	mutex        sync.RWMutex
+	settings     flowSettings
+	before       []BeforeHook[Asset]
+	after        []AfterHook[Asset]
+	beforeAction map[string][]BeforeHook[Asset]
+	afterAction  map[string][]AfterHook[Asset]
+	exitStage    map[string][]BeforeHook[Asset]
+	enterStage   map[string][]AfterHook[Asset]
+}
+
+func newFlowRegistry[Asset Flowable]() *flowRegistry[Asset] {
+	return &flowRegistry[Asset]{
+		beforeAction: map[string][]BeforeHook[Asset]{},
+		afterAction:  map[string][]AfterHook[Asset]{},
+		exitStage:    map[string][]BeforeHook[Asset]{},
+		enterStage:   map[string][]AfterHook[Asset]{},
+	}
+}
+
+// registry is shared by every copy of the flow made after Finish, so hooks and settings can be added to any of them
+func (f *Flow[Asset]) registry() *flowRegistry[Asset] {
+	if f.shared == nil {
+		f.shared = newFlowRegistry[Asset]()
+	}
+	return f.shared
+}
+
+// flowSettings are the optional pieces set with SetHistoryStore, SetAuthorizer, SetLocker and SetConflictRetries
+type flowSettings struct {
+	history         HistoryStore
+	authorizer      Authorizer
+	locker          Locker
+	conflictRetries int
+}
+
+func (f *Flow[Asset]) configure(change func(settings *flowSettings)) {
+	shared := f.registry()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+	change(&shared.settings)
+}
+
+// settings is a snapshot, so one action sees the same settings from start to finish
+func (f Flow[Asset]) settings() flowSettings {
+	if f.shared == nil {
+		return flowSettings{}
+	}
+	f.shared.mutex.RLock()
+	defer f.shared.mutex.RUnlock()
+	return f.shared.settings
+}
+
+// BeforeTransition registers a hook that runs before every transition
+func (f *Flow[Asset]) BeforeTransition(hook BeforeHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.before = append(hooks.before, hook)
+}
+
+// AfterTransition registers a hook that runs after every transition
+func (f *Flow[Asset]) AfterTransition(hook AfterHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.after = append(hooks.after, hook)
+}
+
+// BeforeAction registers a hook that runs before the named transition
+func (f *Flow[Asset]) BeforeAction(action string, hook BeforeHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.beforeAction[action] = append(hooks.beforeAction[action], hook)
+}
+
+// AfterAction registers a hook that runs after the named transition
+func (f *Flow[Asset]) AfterAction(action string, hook AfterHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.afterAction[action] = append(hooks.afterAction[action], hook)
+}
+
+// OnExit registers a hook that runs before an asset leaves the named stage; it can veto like any before hook.
+// Leaving a stage for one outside its parent leaves the parent too.
+func (f *Flow[Asset]) OnExit(stage string, hook BeforeHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.exitStage[stage] = append(hooks.exitStage[stage], hook)
+}
+
+// OnEnter registers a hook that runs after an asset has entered the named stage, or a stage inside it
+// from somewhere outside
+func (f *Flow[Asset]) OnEnter(stage string, hook AfterHook[Asset]) {
+	hooks := f.registry()
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	hooks.enterStage[stage] = append(hooks.enterStage[stage], hook)
+}
+
+// runBefore calls the global hooks, then the action's, then the exit hooks of every stage being left
+// (innermost first), stopping at the first veto
+func (hooks *flowRegistry[Asset]) runBefore(event TransitionEvent[Asset], exited []string) error {
+	if hooks == nil {
+		return nil
+	}
+	// hooks are called without the lock held, so they can register more hooks
+	hooks.mutex.RLock()
+	groups := [][]BeforeHook[Asset]{hooks.before, hooks.beforeAction[event.Action]}
+	for _, stage := range exited {
+		groups = append(groups, hooks.exitStage[stage])
+	}
+	hooks.mutex.RUnlock()
+	for _, group := range groups {
+		for _, hook := range group {
+			if err := hook(event); err != nil {
+				return causeError{ErrVetoed, err}
+			}
+		}
+	}
+	return nil
+}
+
+// runAfter calls the enter hooks of every stage being entered (outermost first), then the action's,
+// then the global hooks
+func (hooks *flowRegistry[Asset]) runAfter(event TransitionEvent[Asset], entered []string) {
+	if hooks == nil {
+		return
+	}
+	hooks.mutex.RLock()
+	groups := [][]AfterHook[Asset]{}
+	for _, stage := range entered {
+		groups = append(groups, hooks.enterStage[stage])
+	}
+	groups = append(groups, hooks.afterAction[event.Action], hooks.after)
+	hooks.mutex.RUnlock()
+	for _, group := range groups {
+		for _, hook := range group {
+			hook(event)
+		}
+	}
+}
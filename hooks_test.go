@@ -0,0 +1,108 @@
+package flowchart
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSafeTransitionHooks(t *testing.T) {
+	flow := generateGranularFlow()
+	calls := []string{}
+
+	flow.BeforeTransition(func(event TransitionEvent[*Butterfly]) error {
+		calls = append(calls, fmt.Sprintf("before %s: %s -> %s", event.Action, event.Origin, event.Destination))
+		return nil
+	})
+	flow.AfterTransition(func(event TransitionEvent[*Butterfly]) {
+		// after hooks only run once the status has actually changed
+		calls = append(calls, fmt.Sprintf("after %s: now %s", event.Action, event.Asset.lifeStage))
+	})
+	flow.BeforeAction(actionEmerge, func(event TransitionEvent[*Butterfly]) error {
+		calls = append(calls, "before emerge")
+		return nil
+	})
+	flow.OnExit(stageCocoon, func(event TransitionEvent[*Butterfly]) error {
+		calls = append(calls, "exit cocoon")
+		return nil
+	})
+	flow.OnEnter(stageMoth, func(event TransitionEvent[*Butterfly]) {
+		calls = append(calls, "enter moth")
+	})
+
+	Bertie := Butterfly{color: "brown", lifeStage: stageCocoon}
+	if _, err := flow.TakeAction(&Bertie, actionEmerge); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"before emerge: cocoon -> moth",
+		"before emerge",
+		"exit cocoon",
+		"enter moth",
+		"after emerge: now moth",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("hooks ran out of order:\n got %q\nwant %q", calls, want)
+	}
+
+	// previews don't run hooks
+	calls = []string{}
+	if _, _, err := flow.PreviewAction(&Bertie, actionSeen); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("PreviewAction should not run hooks, got %q", calls)
+	}
+}
+
+func TestSafeTransitionHookVeto(t *testing.T) {
+	flow := generateGranularFlow()
+	errTooYoung := errors.New("too young to be seen")
+	afterRan := false
+
+	flow.OnExit(stageEgg, func(event TransitionEvent[*Butterfly]) error {
+		if event.Action == actionSeen {
+			return errTooYoung
+		}
+		return nil
+	})
+	flow.AfterTransition(func(event TransitionEvent[*Butterfly]) {
+		afterRan = true
+	})
+
+	Edna := Butterfly{color: "red", lifeStage: stageEgg}
+	change, err := flow.TakeAction(&Edna, actionSeen)
+	if change != INVALID || !errors.Is(err, ErrVetoed) || !errors.Is(err, errTooYoung) {
+		t.Errorf("expected a veto wrapping the hook's error, got %s, %v", change, err)
+	}
+	if Edna.lifeStage != stageEgg || afterRan {
+		t.Errorf("a vetoed transition should not change the asset or run after hooks")
+	}
+
+	// other actions from the same stage are unaffected
+	if change, err := flow.TakeAction(&Edna, actionHatch); err != nil || change != stageCaterpillar {
+		t.Errorf("Wanted %s, got %s, %v", stageCaterpillar, change, err)
+	}
+	if !afterRan {
+		t.Errorf("expected after hooks to run for a successful transition")
+	}
+}
+
+func TestSafeTransitionHooksConcurrentRegistration(t *testing.T) {
+	flow := generateGranularFlow()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ii := 0; ii < 100; ii++ {
+			flow.AfterTransition(func(event TransitionEvent[*Butterfly]) {})
+			flow.BeforeAction(actionHatch, func(event TransitionEvent[*Butterfly]) error { return nil })
+		}
+	}()
+	for ii := 0; ii < 100; ii++ {
+		bug := Butterfly{color: "green", lifeStage: stageEgg}
+		if _, err := flow.TakeAction(&bug, actionHatch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,149 @@
+package flowchart
+
+import (
+	"context"
+	"fmt"
+)
+
+// RegionalFlowable assets are in several independent stages at once, one per region of a ParallelFlow,
+// like a document with both a review status and a legal hold status. The context is shared by every region.
+type RegionalFlowable interface {
+	GetRegionStatus(region string) (string, error)
+	SetRegionStatus(region string, newStatus string, action string) error
+	GetContext() (ValidationTable, error)
+}
+
+// ParallelFlow runs one flow per region over the same asset, instead of one flow over every
+// combination of their stages. Branches in one region can look at the others with InRegion.
+type ParallelFlow[Asset RegionalFlowable] struct {
+	regions map[string]Flow[*regionView[Asset]]
+	order   []string
+}
+
+func NewParallelFlow[Asset RegionalFlowable]() ParallelFlow[Asset] {
+	return ParallelFlow[Asset]{
+		regions: map[string]Flow[*regionView[Asset]]{},
+	}
+}
+
+// InRegion matches when the asset's status in region is stage
+func InRegion(region string, stage string) Guard {
+	return Flag(fmt.Sprintf(regionStageFlag, region, stage), true)
+}
+
+// AddRegion adds a region built from stages and transitions in the usual way. The region is
+// validated like FinishValidated would, and it's an error to add the same region twice.
+func (p *ParallelFlow[Asset]) AddRegion(name string, stages []Stage, transitions []Transition) error {
+	if _, exists := p.regions[name]; exists {
+		return fmt.Errorf("region '%s' was already added", name)
+	}
+	region := NewFlow[*regionView[Asset]]()
+	region.AddStages(stages...)
+	region.AddTransitions(transitions...)
+	flow, err := region.FinishValidated()
+	if err != nil {
+		return fmt.Errorf("region '%s': %w", name, err)
+	}
+	if p.regions == nil {
+		p.regions = map[string]Flow[*regionView[Asset]]{}
+	}
+	p.regions[name] = flow
+	p.order = append(p.order, name)
+	return nil
+}
+
+// Regions lists the regions in the order they were added
+func (p ParallelFlow[Asset]) Regions() []string {
+	return append([]string{}, p.order...)
+}
+
+func (p ParallelFlow[Asset]) TakeAction(asset Asset, action string) (map[string]string, error) {
+	return p.TakeActionContext(context.Background(), asset, action)
+}
+
+// TakeActionContext takes the action in every region whose current stage allows it, and returns
+// where each of those regions ended up. Every region is checked before any of them moves, against
+// the statuses all regions had when the call started, so either they all move or none do
+// (short of SetRegionStatus failing part way).
+func (p ParallelFlow[Asset]) TakeActionContext(ctx context.Context, asset Asset, action string) (map[string]string, error) {
+	if !isPointer(asset) {
+		return nil, fmt.Errorf("%w in TakeAction()", ErrNotPointer)
+	}
+
+	statuses := map[string]string{}
+	for _, name := range p.order {
+		status, err := asset.GetRegionStatus(name)
+		if err != nil {
+			return nil, err
+		}
+		statuses[name] = status
+	}
+
+	// find the regions that take this action from where they are now, and make sure they all can
+	accepting := []string{}
+	known := false
+	for _, name := range p.order {
+		region := p.regions[name]
+		if _, OK := region.stages[statuses[name]]; !OK {
+			err := &TransitionError{Status: statuses[name], Action: action, Err: ErrUnknownStatus}
+			return nil, fmt.Errorf("region '%s': %w", name, err)
+		}
+		if _, OK := region.transitions[action]; !OK {
+			continue
+		}
+		known = true
+		if len(actionLevels(region.stages, statuses[name], action)) == 0 {
+			continue
+		}
+		accepting = append(accepting, name)
+		view := &regionView[Asset]{asset: asset, region: name, statuses: statuses}
+		if _, _, err := region.PreviewAction(view, action); err != nil {
+			return nil, fmt.Errorf("region '%s': %w", name, err)
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("given action '%s': %w", action, ErrUnknownAction)
+	}
+	if len(accepting) == 0 {
+		return nil, fmt.Errorf("given action '%s' from %v: %w", action, statuses, ErrActionNotAllowed)
+	}
+
+	destinations := map[string]string{}
+	for _, name := range accepting {
+		view := &regionView[Asset]{asset: asset, region: name, statuses: statuses}
+		destination, err := p.regions[name].TakeActionContext(ctx, view, action)
+		if err != nil {
+			return destinations, fmt.Errorf("region '%s': %w", name, err)
+		}
+		destinations[name] = destination
+	}
+	return destinations, nil
+}
+
+// regionView is the asset as seen by a single region's flow. Its context carries every region's
+// status as of when the action started.
+type regionView[Asset RegionalFlowable] struct {
+	asset    Asset
+	region   string
+	statuses map[string]string
+}
+
+func (v *regionView[Asset]) GetStatus() (string, error) {
+	return v.statuses[v.region], nil
+}
+
+func (v *regionView[Asset]) SetStatus(newStatus string, action string) error {
+	return v.asset.SetRegionStatus(v.region, newStatus, action)
+}
+
+func (v *regionView[Asset]) GetContext() (ValidationTable, error) {
+	table, err := v.asset.GetContext()
+	if err != nil {
+		return table, err
+	}
+	table = table.MakeCopy()
+	for region, status := range v.statuses {
+		table.AddFlag(fmt.Sprintf(regionStageFlag, region, status), true)
+	}
+	return table, nil
+}
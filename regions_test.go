@@ -0,0 +1,125 @@
+package flowchart
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	regionReview = "review"
+	regionLegal  = "legal"
+)
+
+// Document has a review status and a legal hold status, which change independently
+type Document struct {
+	statuses map[string]string
+}
+
+func (d *Document) GetRegionStatus(region string) (string, error) {
+	return d.statuses[region], nil
+}
+
+func (d *Document) SetRegionStatus(region string, status string, action string) error {
+	d.statuses[region] = status
+	return nil
+}
+
+func (d *Document) GetContext() (ValidationTable, error) {
+	return NewValidationTable()
+}
+
+func buildDocumentFlow() (ParallelFlow[*Document], error) {
+	flow := NewParallelFlow[*Document]()
+	blank, _ := NewValidationTable()
+
+	draft, inReview, published := NewStage("draft", Initial()), NewStage("inReview"), NewStage("published")
+	submit, publish, reset := NewTransition("submit"), NewTransition("publish"), NewTransition("reset")
+	submit.AddStage(&draft, blank, inReview)
+	// nothing under a legal hold gets published
+	publish.AddStage(&inReview, Not(InRegion(regionLegal, "held")), published)
+	reset.AddStage(&inReview, blank, draft)
+	reset.AddStage(&published, blank, draft)
+	err := flow.AddRegion(regionReview, []Stage{draft, inReview, published}, []Transition{submit, publish, reset})
+	if err != nil {
+		return flow, err
+	}
+
+	clear, held := NewStage("clear", Initial()), NewStage("held")
+	hold, release, legalReset := NewTransition("hold"), NewTransition("release"), NewTransition("reset")
+	hold.AddStage(&clear, blank, held)
+	release.AddStage(&held, blank, clear)
+	legalReset.AddStage(&held, blank, clear)
+	return flow, flow.AddRegion(regionLegal, []Stage{clear, held}, []Transition{hold, release, legalReset})
+}
+
+func TestSafeParallelFlow(t *testing.T) {
+	flow, err := buildDocumentFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := flow.Regions(); len(regions) != 2 || regions[0] != regionReview {
+		t.Errorf("expected both regions in order, got %v", regions)
+	}
+
+	memo := Document{statuses: map[string]string{regionReview: "draft", regionLegal: "clear"}}
+	moved, err := flow.TakeAction(&memo, "submit")
+	if err != nil || len(moved) != 1 || moved[regionReview] != "inReview" || memo.statuses[regionLegal] != "clear" {
+		t.Fatalf("expected only the review region to move, got %v, %v", moved, err)
+	}
+	if _, err := flow.TakeAction(&memo, "hold"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the review region can see the legal hold
+	if _, err := flow.TakeAction(&memo, "publish"); !errors.Is(err, ErrNoOutcome) || memo.statuses[regionReview] != "inReview" {
+		t.Errorf("expected the hold to block publishing, got %v", err)
+	}
+
+	// reset is taken in every region that allows it
+	moved, err = flow.TakeAction(&memo, "reset")
+	if err != nil || moved[regionReview] != "draft" || moved[regionLegal] != "clear" {
+		t.Errorf("expected both regions to reset, got %v, %v", moved, err)
+	}
+
+	if _, err := flow.TakeAction(&memo, "release"); !errors.Is(err, ErrActionNotAllowed) {
+		t.Errorf("expected %v releasing a document that isn't held, got %v", ErrActionNotAllowed, err)
+	}
+	if _, err := flow.TakeAction(&memo, "shred"); !errors.Is(err, ErrUnknownAction) {
+		t.Errorf("expected %v, got %v", ErrUnknownAction, err)
+	}
+	if _, err := flow.TakeAction(&memo, "submit"); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := flow.TakeAction(&memo, "publish"); err != nil || moved[regionReview] != "published" {
+		t.Errorf("expected the document to be published once clear, got %v, %v", moved, err)
+	}
+
+	// a region somewhere it doesn't know about is reported as such, not as a refusal
+	memo.statuses[regionReview] = "archived"
+	_, err = flow.TakeAction(&memo, "reset")
+	transitionErr := &TransitionError{}
+	if !errors.Is(err, ErrUnknownStatus) || !errors.As(err, &transitionErr) || transitionErr.Status != "archived" {
+		t.Errorf("expected %v for the archived review, got %v", ErrUnknownStatus, err)
+	}
+	if memo.statuses[regionLegal] != "clear" {
+		t.Errorf("expected nothing to move, got %v", memo.statuses)
+	}
+}
+
+func TestSafeParallelFlowRegions(t *testing.T) {
+	flow, _ := buildDocumentFlow()
+	if err := flow.AddRegion(regionLegal, nil, nil); err == nil {
+		t.Errorf("expected an error adding a region twice")
+	}
+
+	// regions are validated as they're added
+	blank, _ := NewValidationTable()
+	lost := NewTransition("lose")
+	lonely := NewStage("lonely")
+	lost.AddStage(&lonely, blank, NewStage("nowhere"))
+	err := flow.AddRegion("archive", []Stage{lonely}, []Transition{lost})
+	structureErrs := StructureErrors{}
+	if !errors.As(err, &structureErrs) || !structureErrs.Has(DanglingDestination) {
+		t.Errorf("expected a %s error, got %v", DanglingDestination, err)
+	}
+}
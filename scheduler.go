@@ -0,0 +1,310 @@
+package flowchart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the Scheduler what time it is, so tests can move time along by hand
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Timer is an action waiting to be taken on an asset. It only fires if the asset is still in Origin.
+type Timer struct {
+	AssetID  string
+	Origin   string
+	Action   string
+	Due      time.Time
+	Attempts int // how many times it has already failed and been put off
+}
+
+// sameAs reports whether two timers are the same timer, rather than just two for the same action
+func (t Timer) sameAs(other Timer) bool {
+	return t.AssetID == other.AssetID && t.Action == other.Action && t.Origin == other.Origin &&
+		t.Due.Equal(other.Due) && t.Attempts == other.Attempts
+}
+
+// TimerStore keeps pending timers somewhere that outlives the process. An asset has at most one
+// timer per action; saving another replaces it. Remove and Replace only act on the exact timer given
+// (same origin, due time and attempts), so a timer that was read before the asset moved on can't
+// undo the timers scheduled since.
+type TimerStore interface {
+	Save(ctx context.Context, timer Timer) error
+	Remove(ctx context.Context, timer Timer) error
+	Replace(ctx context.Context, old Timer, next Timer) error
+	RemoveAll(ctx context.Context, assetID string) error
+	// Due lists every timer due at or before now, soonest first
+	Due(ctx context.Context, now time.Time) ([]Timer, error)
+}
+
+// AssetLoader finds the asset a timer belongs to. IDs are the same ones history uses, so assets
+// should be Identifiable if timers are meant to survive a restart.
+type AssetLoader[Asset Flowable] func(ctx context.Context, assetID string) (Asset, error)
+
+// Scheduler takes timed actions on behalf of a flow. Whenever an asset moves, its pending timers are
+// cancelled and a timer is started for every transition with a Delay out of its new stage.
+// Nothing fires until Tick is called, which takes every due action through the flow's usual
+// TakeAction path, permissions, hooks, history and all.
+type Scheduler[Asset Flowable] struct {
+	// the actor timed actions are taken as; NewScheduler names it "scheduler" with no roles
+	Actor Actor
+	// OnError hears about timers that couldn't be scheduled after a transition; it may be nil
+	OnError func(err error)
+	// a timer whose action fails for a reason that may pass is put off by RetryDelay, doubling with
+	// every failure up to MaxRetryDelay; NewScheduler sets a minute and an hour
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	flow  Flow[Asset]
+	store TimerStore
+	load  AssetLoader[Asset]
+	clock Clock
+}
+
+// TimerResult is what happened when Tick fired a timer
+type TimerResult struct {
+	Timer       Timer
+	Destination string // INVALID when the action failed
+	Err         error
+}
+
+// NewScheduler hooks a scheduler into flow, so every transition the flow makes from now on keeps
+// the timers up to date. A nil clock uses the SystemClock.
+func NewScheduler[Asset Flowable](flow Flow[Asset], store TimerStore, load AssetLoader[Asset], clock Clock) *Scheduler[Asset] {
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	s := &Scheduler[Asset]{
+		Actor:         Actor{ID: "scheduler"},
+		RetryDelay:    time.Minute,
+		MaxRetryDelay: time.Hour,
+		flow:          flow,
+		store:         store,
+		load:          load,
+		clock:         clock,
+	}
+	flow.AfterTransition(func(event TransitionEvent[Asset]) {
+		if err := s.Schedule(event.Context, event.Asset); err != nil && s.OnError != nil {
+			s.OnError(err)
+		}
+	})
+	return s
+}
+
+// Schedule replaces the asset's pending timers with one for every delayed transition out of its
+// current stage, including those it inherits from its parents. Call it for new assets; the scheduler calls it itself after every transition.
+func (s *Scheduler[Asset]) Schedule(ctx context.Context, asset Asset) error {
+	id := assetID(asset)
+	status, err := adaptFlowable(asset).GetStatusCtx(ctx)
+	if err != nil {
+		return err
+	}
+	if _, OK := s.flow.stages[status]; !OK {
+		return &TransitionError{Status: status, Err: ErrUnknownStatus}
+	}
+
+	if err := s.store.RemoveAll(ctx, id); err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	for _, action := range stageActions(s.flow.stages, status) {
+		tran, OK := s.flow.transitions[action]
+		if !OK || tran.Delay <= 0 {
+			continue
+		}
+		timer := Timer{AssetID: id, Origin: status, Action: action, Due: now.Add(tran.Delay)}
+		if err := s.store.Save(ctx, timer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScheduleAt sets a deadline: action will be taken at due unless the asset leaves its current stage first
+func (s *Scheduler[Asset]) ScheduleAt(ctx context.Context, asset Asset, action string, due time.Time) error {
+	if _, OK := s.flow.transitions[action]; !OK {
+		return fmt.Errorf("given action '%s': %w", action, ErrUnknownAction)
+	}
+	status, err := adaptFlowable(asset).GetStatusCtx(ctx)
+	if err != nil {
+		return err
+	}
+	return s.store.Save(ctx, Timer{AssetID: assetID(asset), Origin: status, Action: action, Due: due})
+}
+
+// Tick fires every timer that's due. A timer is used up once its action is taken, or refused for good
+// (see finalTimerError). Anything else, like a conflict or an asset that couldn't be loaded, puts the
+// timer off (see RetryDelay), and a cancelled ctx leaves it to fire on the next Tick. Timers for assets
+// that have already left their origin stage are dropped without a result. The error is only for
+// trouble with the store itself.
+func (s *Scheduler[Asset]) Tick(ctx context.Context) ([]TimerResult, error) {
+	due, err := s.store.Due(ctx, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	results := []TimerResult{}
+	for _, timer := range due {
+		destination, fired, err := s.fire(ctx, timer)
+		if !fired {
+			if err := s.store.Remove(ctx, timer); err != nil {
+				return results, err
+			}
+			continue
+		}
+		results = append(results, TimerResult{Timer: timer, Destination: destination, Err: err})
+
+		switch {
+		case err == nil, errors.Is(err, ErrHistoryNotRecorded):
+			// the action was taken, and the AfterTransition hook has already replaced the asset's timers
+		case ctx.Err() != nil:
+			// nothing went wrong with the timer itself
+		case finalTimerError(err):
+			if err := s.store.Remove(ctx, timer); err != nil {
+				return results, err
+			}
+		default:
+			if err := s.store.Replace(ctx, timer, s.putOff(timer)); err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// fire takes the timer's action, unless the asset has left the timer's origin stage
+func (s *Scheduler[Asset]) fire(ctx context.Context, timer Timer) (destination string, fired bool, err error) {
+	asset, err := s.load(ctx, timer.AssetID)
+	if err != nil {
+		return INVALID, true, err
+	}
+	status, err := adaptFlowable(asset).GetStatusCtx(ctx)
+	if err != nil {
+		return INVALID, true, err
+	}
+	if status != timer.Origin {
+		return INVALID, false, nil
+	}
+	destination, err = s.flow.TakeActionAs(ctx, s.Actor, asset, timer.Action)
+	return destination, true, err
+}
+
+// putOff is the timer's next attempt, RetryDelay from now and doubling with every failure
+func (s *Scheduler[Asset]) putOff(timer Timer) Timer {
+	delay := s.RetryDelay
+	for ii := 0; ii < timer.Attempts && delay < s.MaxRetryDelay; ii++ {
+		delay *= 2
+	}
+	if s.MaxRetryDelay > 0 && delay > s.MaxRetryDelay {
+		delay = s.MaxRetryDelay
+	}
+	next := timer
+	next.Due = s.clock.Now().Add(delay)
+	next.Attempts++
+	return next
+}
+
+// finalTimerError reports whether a timer's action failed in a way that trying again won't fix.
+// The scheduler's Actor won't gain roles between ticks, so permission is final too.
+func finalTimerError(err error) bool {
+	for _, final := range []error{ErrNoOutcome, ErrActionNotAllowed, ErrUnknownAction, ErrPermissionDenied} {
+		if errors.Is(err, final) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryTimers is a TimerStore that keeps everything in memory; it is safe for concurrent use
+type MemoryTimers struct {
+	mutex  sync.Mutex
+	timers map[string]map[string]Timer // by asset, then action
+}
+
+func NewMemoryTimers() *MemoryTimers {
+	return &MemoryTimers{
+		timers: map[string]map[string]Timer{},
+	}
+}
+
+func (m *MemoryTimers) Save(_ context.Context, timer Timer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.timers[timer.AssetID] == nil {
+		m.timers[timer.AssetID] = map[string]Timer{}
+	}
+	m.timers[timer.AssetID][timer.Action] = timer
+	return nil
+}
+
+func (m *MemoryTimers) Remove(_ context.Context, timer Timer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stored, OK := m.timers[timer.AssetID][timer.Action]; !OK || !stored.sameAs(timer) {
+		return nil
+	}
+	delete(m.timers[timer.AssetID], timer.Action)
+	if len(m.timers[timer.AssetID]) == 0 {
+		delete(m.timers, timer.AssetID)
+	}
+	return nil
+}
+
+func (m *MemoryTimers) Replace(_ context.Context, old Timer, next Timer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stored, OK := m.timers[old.AssetID][old.Action]; !OK || !stored.sameAs(old) {
+		return nil
+	}
+	delete(m.timers[old.AssetID], old.Action)
+	if m.timers[next.AssetID] == nil {
+		m.timers[next.AssetID] = map[string]Timer{}
+	}
+	m.timers[next.AssetID][next.Action] = next
+	return nil
+}
+
+func (m *MemoryTimers) RemoveAll(_ context.Context, assetID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.timers, assetID)
+	return nil
+}
+
+func (m *MemoryTimers) Due(_ context.Context, now time.Time) ([]Timer, error) {
+	return m.list(func(timer Timer) bool { return !timer.Due.After(now) }), nil
+}
+
+// Pending lists every timer not yet fired, soonest first
+func (m *MemoryTimers) Pending() []Timer {
+	return m.list(func(Timer) bool { return true })
+}
+
+func (m *MemoryTimers) list(include func(Timer) bool) []Timer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	timers := []Timer{}
+	for _, assetID := range sortedKeys(m.timers) {
+		for _, action := range sortedKeys(m.timers[assetID]) {
+			if timer := m.timers[assetID][action]; include(timer) {
+				timers = append(timers, timer)
+			}
+		}
+	}
+	sort.SliceStable(timers, func(i, j int) bool {
+		return timers[i].Due.Before(timers[j].Due)
+	})
+	return timers
+}
@@ -0,0 +1,301 @@
+package flowchart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func buildTimedFlow() Flow[*Butterfly] {
+	unfinished := buildSimpleFlow()
+	age := unfinished.Transitions[actionAge]
+	age.Delay = 24 * time.Hour
+	unfinished.Transitions[actionAge] = age
+	return unfinished.Finish()
+}
+
+func TestSafeScheduler(t *testing.T) {
+	flow := buildTimedFlow()
+	store := NewMemoryHistory()
+	flow.SetHistoryStore(store)
+
+	bugs := map[string]*Butterfly{}
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		bug, OK := bugs[id]
+		if !OK {
+			return nil, fmt.Errorf("no butterfly %s", id)
+		}
+		return bug, nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	timers := NewMemoryTimers()
+	scheduler := NewScheduler(flow, timers, load, clock)
+	ctx := context.Background()
+
+	Tabitha := &Butterfly{color: "green", lifeStage: stageEgg}
+	bugs[assetID(Tabitha)] = Tabitha
+	if err := scheduler.Schedule(ctx, Tabitha); err != nil {
+		t.Fatal(err)
+	}
+	pending := timers.Pending()
+	if len(pending) != 1 || pending[0].Action != actionAge || !pending[0].Due.Equal(clock.now.Add(24*time.Hour)) {
+		t.Fatalf("expected one age timer a day from now, got %v", pending)
+	}
+
+	clock.Advance(12 * time.Hour)
+	if results, err := scheduler.Tick(ctx); err != nil || len(results) != 0 {
+		t.Errorf("nothing should fire early, got %v, %v", results, err)
+	}
+
+	// egg, caterpillar, cocoon, another day in the cocoon, then out
+	want := []string{stageCaterpillar, stageCocoon, stageCocoon, stageButterfly}
+	for _, stage := range want {
+		clock.Advance(24 * time.Hour)
+		results, err := scheduler.Tick(ctx)
+		if err != nil || len(results) != 1 || results[0].Err != nil || results[0].Destination != stage {
+			t.Fatalf("expected a move to %s, got %+v, %v", stage, results, err)
+		}
+	}
+	if Tabitha.lifeStage != stageButterfly || len(timers.Pending()) != 0 {
+		t.Errorf("expected a butterfly with nothing left to do, got %s with %v", Tabitha.lifeStage, timers.Pending())
+	}
+
+	// timed actions go through the usual checks and are recorded as the scheduler
+	entries, _ := flow.History(ctx, Tabitha)
+	if len(entries) != 4 || entries[0].Actor.ID != "scheduler" {
+		t.Errorf("expected four scheduled entries, got %+v", entries)
+	}
+}
+
+func TestSafeSchedulerDeadlines(t *testing.T) {
+	flow := buildTimedFlow()
+	bugs := map[string]*Butterfly{}
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		return bugs[id], nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	timers := NewMemoryTimers()
+	scheduler := NewScheduler(flow, timers, load, clock)
+	ctx := context.Background()
+
+	Ursula := &Butterfly{color: "red", lifeStage: stageCaterpillar}
+	bugs[assetID(Ursula)] = Ursula
+	if err := scheduler.ScheduleAt(ctx, Ursula, "fly", clock.now); !errors.Is(err, ErrUnknownAction) {
+		t.Errorf("expected %v scheduling an unknown action, got %v", ErrUnknownAction, err)
+	}
+	if err := scheduler.ScheduleAt(ctx, Ursula, actionSeen, clock.now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// moving on by hand cancels the deadline and starts the new stage's timers
+	if _, err := flow.TakeAction(Ursula, actionAge); err != nil {
+		t.Fatal(err)
+	}
+	pending := timers.Pending()
+	if len(pending) != 1 || pending[0].Origin != stageCocoon || pending[0].Action != actionAge {
+		t.Fatalf("expected only the cocoon's age timer, got %v", pending)
+	}
+
+	// a timer for a stage the asset has since left is dropped
+	timers.Save(ctx, Timer{AssetID: assetID(Ursula), Origin: stageEgg, Action: actionSeen, Due: clock.now})
+	if results, err := scheduler.Tick(ctx); err != nil || len(results) != 0 || Ursula.lifeStage != stageCocoon {
+		t.Errorf("expected the stale timer to be dropped, got %v, %v", results, err)
+	}
+
+	// failures are reported per timer, and a refusal uses the timer up
+	timers.Save(ctx, Timer{AssetID: assetID(Ursula), Origin: stageCocoon, Action: actionSeen, Due: clock.now})
+	results, err := scheduler.Tick(ctx)
+	if err != nil || len(results) != 1 || !errors.Is(results[0].Err, ErrActionNotAllowed) {
+		t.Errorf("expected the cocoon to refuse being seen, got %+v, %v", results, err)
+	}
+	if pending := timers.Pending(); len(pending) != 1 || pending[0].Action != actionAge {
+		t.Errorf("expected the refused timer to be used up, got %v", pending)
+	}
+}
+
+func TestSafeTransitionDelaySerialization(t *testing.T) {
+	data, err := json.Marshal(buildTimedFlow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := UnfinishedFlow[*Butterfly]{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if delay := loaded.Transitions[actionAge].Delay; delay != 24*time.Hour {
+		t.Errorf("expected the delay to survive a round trip, got %v", delay)
+	}
+
+	broken := `{"stages": [], "transitions": [{"name": "age", "delay": "soon", "branches": []}]}`
+	if err := json.Unmarshal([]byte(broken), &loaded); err == nil {
+		t.Errorf("expected an error for a bad delay")
+	}
+}
+
+func TestSafeSchedulerLateSettings(t *testing.T) {
+	flow := buildTimedFlow()
+	Vera := &Butterfly{color: "green", lifeStage: stageEgg}
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		return Vera, nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	scheduler := NewScheduler(flow, NewMemoryTimers(), load, clock)
+	ctx := context.Background()
+
+	// the scheduler has its own copy of the flow, but settings made afterwards still reach it
+	store := NewMemoryHistory()
+	flow.SetHistoryStore(store)
+	asked := []string{}
+	flow.SetAuthorizer(AuthorizerFunc(func(_ context.Context, actor Actor, action, _ string) error {
+		asked = append(asked, actor.ID+" "+action)
+		return nil
+	}))
+
+	if err := scheduler.Schedule(ctx, Vera); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(24 * time.Hour)
+	if results, err := scheduler.Tick(ctx); err != nil || len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("expected the timer to fire, got %+v, %v", results, err)
+	}
+	if entries, _ := store.History(ctx, assetID(Vera)); len(entries) != 1 || len(asked) != 1 || asked[0] != "scheduler "+actionAge {
+		t.Errorf("expected the timed action to be recorded and authorized, got %+v and %q", entries, asked)
+	}
+}
+
+func TestSafeSchedulerKeepsTimersOnTransientFailures(t *testing.T) {
+	flow := buildTimedFlow()
+	Wanda := &Butterfly{color: "green", lifeStage: stageEgg}
+	errOffline := errors.New("database offline")
+	offline := true
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		if offline {
+			return nil, errOffline
+		}
+		return Wanda, nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	timers := NewMemoryTimers()
+	scheduler := NewScheduler(flow, timers, load, clock)
+	ctx := context.Background()
+	if err := scheduler.Schedule(ctx, Wanda); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(24 * time.Hour)
+
+	// an asset that can't be loaded keeps its timer, put off a little longer every time
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		results, err := scheduler.Tick(ctx)
+		if err != nil || len(results) != 1 || !errors.Is(results[0].Err, errOffline) {
+			t.Fatalf("expected the load to fail, got %+v, %v", results, err)
+		}
+		pending := timers.Pending()
+		if len(pending) != 1 || pending[0].Attempts != attempt+1 || !pending[0].Due.Equal(clock.now.Add(delay)) {
+			t.Fatalf("expected the timer to be put off by %v, got %v", delay, pending)
+		}
+		clock.Advance(delay)
+	}
+
+	// a tick that's given up on leaves it as it was
+	offline = false
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	results, err := scheduler.Tick(cancelled)
+	if pending := timers.Pending(); err != nil || len(results) != 1 || !errors.Is(results[0].Err, context.Canceled) || len(pending) != 1 || pending[0].Attempts != 2 {
+		t.Fatalf("expected the timer to survive the cancelled tick, got %+v, %v, %v", results, err, timers.Pending())
+	}
+	if Wanda.lifeStage != stageEgg {
+		t.Fatalf("expected the cancelled tick to leave the egg alone, got %s", Wanda.lifeStage)
+	}
+
+	results, err = scheduler.Tick(ctx)
+	if err != nil || len(results) != 1 || results[0].Destination != stageCaterpillar {
+		t.Errorf("expected the kept timer to fire, got %+v, %v", results, err)
+	}
+	if pending := timers.Pending(); len(pending) != 1 || pending[0].Origin != stageCaterpillar {
+		t.Errorf("expected only the caterpillar's timer, got %v", pending)
+	}
+}
+
+func TestSafeSchedulerTimersDueTogether(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	for _, action := range []string{actionAge, actionSeen} {
+		tran := unfinished.Transitions[action]
+		tran.Delay = 24 * time.Hour
+		unfinished.Transitions[action] = tran
+	}
+	flow := unfinished.Finish()
+	Xena := &Butterfly{color: "green", lifeStage: stageEgg}
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		return Xena, nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	timers := NewMemoryTimers()
+	scheduler := NewScheduler(flow, timers, load, clock)
+	ctx := context.Background()
+	if err := scheduler.Schedule(ctx, Xena); err != nil {
+		t.Fatal(err)
+	}
+
+	// age fires first, and the egg's seen timer is out of date by the time its turn comes
+	clock.Advance(24 * time.Hour)
+	if _, err := scheduler.Tick(ctx); err != nil || Xena.lifeStage != stageCaterpillar {
+		t.Fatalf("expected a caterpillar, got %s, %v", Xena.lifeStage, err)
+	}
+	pending := timers.Pending()
+	if len(pending) != 2 || pending[0].Origin != stageCaterpillar || pending[1].Origin != stageCaterpillar {
+		t.Errorf("expected both of the caterpillar's timers, got %v", pending)
+	}
+}
+
+func TestSafeSchedulerPermissionIsFinal(t *testing.T) {
+	unfinished := buildSimpleFlow()
+	age := unfinished.Transitions[actionAge]
+	age.Delay = 24 * time.Hour
+	age.Roles = []string{"keeper"}
+	unfinished.Transitions[actionAge] = age
+	flow := unfinished.Finish()
+	store := NewMemoryHistory()
+	flow.SetHistoryStore(store)
+
+	Yara := &Butterfly{color: "green", lifeStage: stageEgg}
+	load := func(_ context.Context, id string) (*Butterfly, error) {
+		return Yara, nil
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}
+	timers := NewMemoryTimers()
+	scheduler := NewScheduler(flow, timers, load, clock)
+	ctx := context.Background()
+	if err := scheduler.Schedule(ctx, Yara); err != nil {
+		t.Fatal(err)
+	}
+
+	// the scheduler has no roles, and never will, so there's no point asking again
+	clock.Advance(24 * time.Hour)
+	results, err := scheduler.Tick(ctx)
+	if err != nil || len(results) != 1 || !errors.Is(results[0].Err, ErrPermissionDenied) {
+		t.Fatalf("expected %v, got %+v, %v", ErrPermissionDenied, results, err)
+	}
+	clock.Advance(24 * time.Hour)
+	if results, err := scheduler.Tick(ctx); err != nil || len(results) != 0 || len(timers.Pending()) != 0 {
+		t.Errorf("expected the refused timer to be gone, got %+v, %v, %v", results, err, timers.Pending())
+	}
+	if entries, _ := store.History(ctx, assetID(Yara)); len(entries) != 1 {
+		t.Errorf("expected a single refusal in history, got %d", len(entries))
+	}
+}
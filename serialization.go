@@ -0,0 +1,234 @@
+package flowchart
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Flows are stored as a list of stages and a list of transitions. Every branch of a transition is
+// an object naming the stage it leaves, the flags the context must have, and the stage it goes to.
+// Branches are kept in declaration order, which is the order they're tried in (after priority).
+//
+//	{
+//	  "stages": [
+//	    {"name": "cocoon", "transitions": ["emerge"], "initial": true, "metadata": {"label": "Cocoon"}},
+//	    {"name": "butterfly", "terminal": true},
+//	    {"name": "moth", "terminal": true}
+//	  ],
+//	  "transitions": [
+//	    {
+//	      "name": "emerge",
+//	      "mostSpecificWins": false,
+//	      "roles": ["gardener"],
+//	      "delay": "72h",
+//	      "branches": [
+//	        {"from": "cocoon", "when": {"isBrown": false}, "to": "butterfly"},
+//	        {"from": "cocoon", "when": {"isBrown": true}, "to": "moth", "priority": 1},
+//	        {"from": "cocoon", "guard": "isGrey | isBlack", "to": "moth"}
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// Guards are written in their compact string form. The YAML form uses the same field names.
+type flowDocument struct {
+	Stages      []stageDocument      `json:"stages" yaml:"stages"`
+	Transitions []transitionDocument `json:"transitions" yaml:"transitions"`
+}
+
+type stageDocument struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Transitions []string               `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	Initial     bool                   `json:"initial,omitempty" yaml:"initial,omitempty"`
+	Terminal    bool                   `json:"terminal,omitempty" yaml:"terminal,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Parent      string                 `json:"parent,omitempty" yaml:"parent,omitempty"`
+}
+
+type transitionDocument struct {
+	Name             string           `json:"name" yaml:"name"`
+	MostSpecificWins bool             `json:"mostSpecificWins,omitempty" yaml:"mostSpecificWins,omitempty"`
+	Roles            []string         `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Delay            string           `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Branches         []branchDocument `json:"branches" yaml:"branches"`
+}
+
+type branchDocument struct {
+	From     string          `json:"from" yaml:"from"`
+	When     map[string]bool `json:"when,omitempty" yaml:"when,omitempty"`
+	Guard    string          `json:"guard,omitempty" yaml:"guard,omitempty"`
+	To       string          `json:"to" yaml:"to"`
+	Priority int             `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+func (f UnfinishedFlow[Asset]) MarshalJSON() ([]byte, error) {
+	doc, err := newFlowDocument(f.Stages, f.Transitions)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func (f *UnfinishedFlow[Asset]) UnmarshalJSON(data []byte) error {
+	doc := flowDocument{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return loadFlowDocument(doc, f)
+}
+
+func (f UnfinishedFlow[Asset]) MarshalYAML() (interface{}, error) {
+	return newFlowDocument(f.Stages, f.Transitions)
+}
+
+func (f *UnfinishedFlow[Asset]) UnmarshalYAML(value *yaml.Node) error {
+	doc := flowDocument{}
+	if err := value.Decode(&doc); err != nil {
+		return err
+	}
+	return loadFlowDocument(doc, f)
+}
+
+func (f Flow[Asset]) MarshalJSON() ([]byte, error) {
+	doc, err := newFlowDocument(f.stages, f.transitions)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON loads a finished flow. Like Finish, it doesn't validate the flow;
+// unmarshal into an UnfinishedFlow and use FinishValidated for that.
+func (f *Flow[Asset]) UnmarshalJSON(data []byte) error {
+	unfinished := UnfinishedFlow[Asset]{}
+	if err := unfinished.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*f = unfinished.Finish()
+	return nil
+}
+
+func (f Flow[Asset]) MarshalYAML() (interface{}, error) {
+	return newFlowDocument(f.stages, f.transitions)
+}
+
+func (f *Flow[Asset]) UnmarshalYAML(value *yaml.Node) error {
+	unfinished := UnfinishedFlow[Asset]{}
+	if err := unfinished.UnmarshalYAML(value); err != nil {
+		return err
+	}
+	*f = unfinished.Finish()
+	return nil
+}
+
+func newFlowDocument(stages map[string]Stage, transitions map[string]Transition) (flowDocument, error) {
+	doc := flowDocument{
+		Stages:      []stageDocument{},
+		Transitions: []transitionDocument{},
+	}
+
+	for _, name := range sortedKeys(stages) {
+		stage := stages[name]
+		doc.Stages = append(doc.Stages, stageDocument{
+			Name:        stage.Name,
+			Transitions: stage.Transitions,
+			Initial:     stage.Initial,
+			Terminal:    stage.Terminal,
+			Metadata:    stage.Metadata,
+			Parent:      stage.Parent,
+		})
+	}
+
+	for _, name := range sortedKeys(transitions) {
+		tran := transitions[name]
+		tranDoc := transitionDocument{
+			Name:             tran.Name,
+			MostSpecificWins: tran.MostSpecificWins,
+			Roles:            tran.Roles,
+			Branches:         []branchDocument{},
+		}
+		if tran.Delay != 0 {
+			tranDoc.Delay = tran.Delay.String()
+		}
+		for _, key := range tran.declaredKeys() {
+			table, guard, err := key.toCondition()
+			if err != nil {
+				return doc, err
+			}
+			origin, err := branchOrigin(key)
+			if err != nil {
+				return doc, err
+			}
+			originFlag := fmt.Sprintf(originStageFlag, origin)
+
+			when := map[string]bool{}
+			for _, tag := range table.tags {
+				if tag != originFlag {
+					when[tag] = table.table[tag]
+				}
+			}
+			tranDoc.Branches = append(tranDoc.Branches, branchDocument{
+				From:     origin,
+				When:     when,
+				Guard:    guard.String(),
+				To:       tran.NextStages[key],
+				Priority: tran.Priorities[key],
+			})
+		}
+		doc.Transitions = append(doc.Transitions, tranDoc)
+	}
+
+	return doc, nil
+}
+
+// loadFlowDocument replaces everything in f with the contents of doc
+func loadFlowDocument[Asset Flowable](doc flowDocument, f *UnfinishedFlow[Asset]) error {
+	*f = NewFlow[Asset]()
+
+	for _, stageDoc := range doc.Stages {
+		stage := NewStage(stageDoc.Name)
+		stage.Transitions = append(stage.Transitions, stageDoc.Transitions...)
+		stage.Initial, stage.Terminal = stageDoc.Initial, stageDoc.Terminal
+		stage.Metadata, stage.Parent = stageDoc.Metadata, stageDoc.Parent
+		f.AddStages(stage)
+	}
+
+	for _, tranDoc := range doc.Transitions {
+		tran := NewTransition(tranDoc.Name)
+		tran.MostSpecificWins = tranDoc.MostSpecificWins
+		tran.Roles = tranDoc.Roles
+		if tranDoc.Delay != "" {
+			delay, err := time.ParseDuration(tranDoc.Delay)
+			if err != nil {
+				return fmt.Errorf("transition '%s' has a bad delay: %w", tranDoc.Name, err)
+			}
+			tran.Delay = delay
+		}
+		for _, branchDoc := range tranDoc.Branches {
+			if branchDoc.To == "" {
+				return fmt.Errorf("branch of transition '%s' from '%s' has no destination", tranDoc.Name, branchDoc.From)
+			}
+			table := ValidationTableFrom(branchDoc.When)
+			var condition Condition = table
+			if branchDoc.Guard != "" {
+				guard, err := ParseGuard(branchDoc.Guard)
+				if err != nil {
+					return err
+				}
+				condition = tableAndGuard{table, guard}
+			}
+			key := tran.addBranch(branchDoc.From, condition, branchDoc.To)
+			if branchDoc.Priority != 0 {
+				if tran.Priorities == nil {
+					tran.Priorities = map[ValidationString]int{}
+				}
+				tran.Priorities[key] = branchDoc.Priority
+			}
+		}
+		f.AddTransitions(tran)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package flowchart
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSafeFlowJSONRoundTrip(t *testing.T) {
+	for _, build := range []func() UnfinishedFlow[*Butterfly]{buildGranularFlow, buildSimpleFlow} {
+		original := build()
+		original.AddStages(NewStage(stageEaten))
+
+		data, err := json.Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := UnfinishedFlow[*Butterfly]{}
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.Validate(stageEgg); err != nil {
+			t.Errorf("loaded flow should still be valid: %v", err)
+		}
+
+		again, err := json.Marshal(loaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, again) {
+			t.Errorf("round trip changed the flow:\n%s\n%s", data, again)
+		}
+
+		// finished flows round trip the same way
+		finishedData, err := json.Marshal(original.Finish())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, finishedData) {
+			t.Errorf("finished and unfinished flows should serialize identically:\n%s\n%s", data, finishedData)
+		}
+	}
+
+	// a loaded flow behaves like the one it came from
+	data, _ := json.Marshal(generateGranularFlow())
+	generateLoadedFlow := func() Flow[*Butterfly] {
+		loaded := Flow[*Butterfly]{}
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		return loaded
+	}
+	happyPath := []butterflyTest{
+		{action: actionHatch, result: stageCaterpillar},
+		{action: actionGrow, result: stageCocoon},
+		{action: actionEmerge, result: stageMoth},
+		{action: actionSeen, result: stageEaten},
+	}
+	runButterflyTests(&Butterfly{color: "brown", lifeStage: stageEgg}, happyPath, generateLoadedFlow, t)
+}
+
+func TestSafeFlowYAMLRoundTrip(t *testing.T) {
+	source := []byte(`
+stages:
+  - name: cocoon
+    transitions: [emerge]
+  - name: butterfly
+  - name: moth
+transitions:
+  - name: emerge
+    branches:
+      - from: cocoon
+        to: butterfly
+      - from: cocoon
+        when:
+          isBrown: true
+        to: moth
+        priority: 1
+`)
+	loaded := Flow[*Butterfly]{}
+	if err := yaml.Unmarshal(source, &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	// the moth branch is declared second but has the higher priority
+	bug := Butterfly{color: "brown", lifeStage: stageCocoon}
+	change, err := loaded.TakeAction(&bug, actionEmerge)
+	if err != nil || change != stageMoth {
+		t.Errorf("Wanted %s, got %s, %v", stageMoth, change, err)
+	}
+
+	data, err := yaml.Marshal(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := Flow[*Butterfly]{}
+	if err := yaml.Unmarshal(data, &reloaded); err != nil {
+		t.Fatal(err)
+	}
+	again, err := yaml.Marshal(reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("round trip changed the flow:\n%s\n%s", data, again)
+	}
+
+	if err := yaml.Unmarshal([]byte("transitions: [{name: emerge, branches: [{from: cocoon}]}]"), &reloaded); err == nil {
+		t.Errorf("expected an error loading a branch with no destination")
+	}
+}
+
+func TestSafeFlowJSONOriginlessBranch(t *testing.T) {
+	// a branch set straight on NextStages has no origin flag, so it applies from any stage with the action
+	unfinished := buildSimpleFlow()
+	unfinished.AddStages(NewStage(stageEaten))
+	seen := unfinished.Transitions[actionSeen]
+	seen.NextStages[" "] = stageEaten
+	unfinished.Transitions[actionSeen] = seen
+
+	data, err := json.Marshal(unfinished)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := UnfinishedFlow[*Butterfly]{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, OK := loaded.Transitions[actionSeen].NextStages[" "]; !OK {
+		t.Errorf("expected the origin-less branch to keep its key, got %v", loaded.Transitions[actionSeen].NextStages)
+	}
+
+	// green bugs can't be seen by the egg's own branch, so only the origin-less one can take them
+	for _, flow := range []Flow[*Butterfly]{unfinished.Finish(), loaded.Finish()} {
+		Gilbert := Butterfly{color: "green", lifeStage: stageEgg}
+		if change, err := flow.TakeAction(&Gilbert, actionSeen); err != nil || change != stageEaten {
+			t.Errorf("expected the origin-less branch to move him to %s, got %s, %v", stageEaten, change, err)
+		}
+	}
+}
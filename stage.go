@@ -1,17 +1,185 @@
 package flowchart
 
+import "sort"
+
 type Stage struct {
 	Name        string   `json:"name"`
 	Transitions []string `json:"transitions"`
+	// assets start out in initial stages; terminal stages are the end of the line and can't have transitions
+	Initial  bool `json:"initial,omitempty"`
+	Terminal bool `json:"terminal,omitempty"`
+	// anything else worth knowing about the stage, like display labels or SLA targets; see MetadataKey
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// the composite stage this one sits in. Assets in this stage can also take any action the parent
+	// (or its parent, and so on) allows, though their status is still this stage.
+	Parent string `json:"parent,omitempty"`
 }
 
-func NewStage(name string) Stage {
-	return Stage{
+// StageOption sets something about a stage as NewStage builds it
+type StageOption func(*Stage)
+
+func NewStage(name string, options ...StageOption) Stage {
+	stage := Stage{
 		Name:        name,
 		Transitions: []string{},
 	}
+	for _, option := range options {
+		option(&stage)
+	}
+	return stage
+}
+
+// Initial marks the stage as one assets can start in
+func Initial() StageOption {
+	return func(s *Stage) { s.Initial = true }
+}
+
+// Terminal marks the stage as one assets never leave
+func Terminal() StageOption {
+	return func(s *Stage) { s.Terminal = true }
+}
+
+// ChildOf puts the stage inside a composite parent stage
+func ChildOf(parent string) StageOption {
+	return func(s *Stage) { s.Parent = parent }
+}
+
+// WithMetadata stores value on the stage under key
+func WithMetadata[T any](key MetadataKey[T], value T) StageOption {
+	return func(s *Stage) { key.Set(s, value) }
 }
 
 func (s *Stage) addTransition(t string) {
 	s.Transitions = append(s.Transitions, t)
 }
+
+// MetadataKey names a piece of stage metadata along with the type of its value, so it can be read
+// back without type assertions:
+//
+//	var slaKey = NewMetadataKey[time.Duration]("sla")
+//	cocoon := NewStage("cocoon", WithMetadata(slaKey, 72*time.Hour))
+//	sla, OK := slaKey.Get(cocoon)
+//
+// Metadata loaded from JSON or YAML comes back with whatever types the decoder picked (numbers as
+// float64 from JSON, for example), and Get reports those as missing.
+type MetadataKey[T any] struct {
+	Name string
+}
+
+func NewMetadataKey[T any](name string) MetadataKey[T] {
+	return MetadataKey[T]{Name: name}
+}
+
+func (k MetadataKey[T]) Get(stage Stage) (T, bool) {
+	value, OK := stage.Metadata[k.Name].(T)
+	return value, OK
+}
+
+func (k MetadataKey[T]) Set(stage *Stage, value T) {
+	if stage.Metadata == nil {
+		stage.Metadata = map[string]interface{}{}
+	}
+	stage.Metadata[k.Name] = value
+}
+
+// Stage looks up a stage of the flow by name
+func (f Flow[Asset]) Stage(name string) (Stage, bool) {
+	stage, OK := f.stages[name]
+	return stage, OK
+}
+
+// InitialStages lists the stages marked Initial, sorted by name
+func (f Flow[Asset]) InitialStages() []string {
+	return initialStages(f.stages)
+}
+
+// IsTerminal reports whether the stage is marked Terminal; unknown stages aren't
+func (f Flow[Asset]) IsTerminal(stage string) bool {
+	return f.stages[stage].Terminal
+}
+
+func initialStages(stages map[string]Stage) []string {
+	initial := []string{}
+	for name, stage := range stages {
+		if stage.Initial {
+			initial = append(initial, name)
+		}
+	}
+	sort.Strings(initial)
+	return initial
+}
+
+// ancestry lists the stage followed by its parents, innermost first. It stops early at a parent that
+// isn't a stage of the flow, or one it has already listed.
+func ancestry(stages map[string]Stage, name string) []string {
+	chain := []string{name}
+	for parent := stages[name].Parent; parent != ""; parent = stages[parent].Parent {
+		if _, OK := stages[parent]; !OK || contains(chain, parent) {
+			break
+		}
+		chain = append(chain, parent)
+	}
+	return chain
+}
+
+// isComposite reports whether any stage sits inside this one
+func isComposite(stages map[string]Stage, name string) bool {
+	for _, stage := range stages {
+		if stage.Parent == name {
+			return true
+		}
+	}
+	return false
+}
+
+// actionSources lists the stages whose transitions an asset in the stage can take: its whole ancestry,
+// unless it's Terminal, since nothing leaves a terminal stage, not even by a parent's transition
+func actionSources(stages map[string]Stage, name string) []string {
+	if stages[name].Terminal {
+		return []string{name}
+	}
+	return ancestry(stages, name)
+}
+
+// stageActions lists every action an asset in the stage can take, its own first and then its parents'
+func stageActions(stages map[string]Stage, name string) []string {
+	actions := []string{}
+	for _, level := range actionSources(stages, name) {
+		for _, action := range stages[level].Transitions {
+			if !contains(actions, action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions
+}
+
+// actionLevels lists the stages in the ancestry of name that allow action, innermost first.
+// Branches from inner stages are tried before their parents'.
+func actionLevels(stages map[string]Stage, name string, action string) []string {
+	levels := []string{}
+	for _, level := range actionSources(stages, name) {
+		if contains(stages[level].Transitions, action) {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// stageBoundary works out which stages a transition leaves and enters. A stage is always left and
+// entered itself, even for a transition back to itself; shared parents are neither. exited is
+// innermost first and entered outermost first.
+func stageBoundary(stages map[string]Stage, origin string, destination string) (exited []string, entered []string) {
+	from, to := ancestry(stages, origin), ancestry(stages, destination)
+	for ii, stage := range from {
+		if ii == 0 || !contains(to, stage) {
+			exited = append(exited, stage)
+		}
+	}
+	for ii := len(to) - 1; ii >= 0; ii-- {
+		if ii == 0 || !contains(from, to[ii]) {
+			entered = append(entered, to[ii])
+		}
+	}
+	return exited, entered
+}
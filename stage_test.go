@@ -0,0 +1,244 @@
+package flowchart
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	labelKey = NewMetadataKey[string]("label")
+	slaKey   = NewMetadataKey[time.Duration]("sla")
+)
+
+// buildMarkedFlow is the simple flow with its start and ends marked
+func buildMarkedFlow() UnfinishedFlow[*Butterfly] {
+	unfinished := buildSimpleFlow()
+	for name, options := range map[string][]StageOption{
+		stageEgg:       {Initial(), WithMetadata(labelKey, "Egg")},
+		stageCocoon:    {WithMetadata(slaKey, 72*time.Hour)},
+		stageButterfly: {Terminal()},
+	} {
+		stage := unfinished.Stages[name]
+		for _, option := range options {
+			option(&stage)
+		}
+		unfinished.Stages[name] = stage
+	}
+	return unfinished
+}
+
+func TestSafeStageMetadata(t *testing.T) {
+	stage := NewStage("cocoon", Initial(), WithMetadata(slaKey, time.Hour), WithMetadata(labelKey, "Cocoon"))
+	if !stage.Initial || stage.Terminal {
+		t.Errorf("expected an initial, non-terminal stage, got %+v", stage)
+	}
+	if sla, OK := slaKey.Get(stage); !OK || sla != time.Hour {
+		t.Errorf("expected an hour, got %v, %v", sla, OK)
+	}
+	if _, OK := NewMetadataKey[int]("label").Get(stage); OK {
+		t.Errorf("a key of the wrong type shouldn't find anything")
+	}
+	if _, OK := labelKey.Get(NewStage("egg")); OK {
+		t.Errorf("a stage without metadata shouldn't find anything")
+	}
+
+	flow := buildMarkedFlow()
+	seen := flow.Transitions[actionSeen]
+	// butterflies are terminal here, so take away the way out
+	butterfly := flow.Stages[stageButterfly]
+	butterfly.Transitions = []string{}
+	flow.Stages[stageButterfly] = butterfly
+	finished := flow.Finish()
+
+	if initial := finished.InitialStages(); len(initial) != 1 || initial[0] != stageEgg {
+		t.Errorf("expected only %s to be initial, got %v", stageEgg, initial)
+	}
+	if !finished.IsTerminal(stageButterfly) || finished.IsTerminal(stageMoth) || finished.IsTerminal("larva") {
+		t.Errorf("expected only %s to be terminal", stageButterfly)
+	}
+	if egg, _ := finished.Stage(stageEgg); egg.Metadata["label"] != "Egg" {
+		t.Errorf("expected the egg's label, got %v", egg.Metadata)
+	}
+
+	// the branch out of the butterfly stage is still there, which is a problem now
+	errs, OK := flow.Validate().(StructureErrors)
+	if !OK || !errs.Has(TerminalTransition) {
+		t.Errorf("expected a %s error, got %v", TerminalTransition, errs)
+	}
+
+	// the initial stage is used for reachability when no start is given
+	seen.NextStages = map[ValidationString]string{}
+	for key, destination := range flow.Transitions[actionSeen].NextStages {
+		if origin, _ := branchOrigin(key); origin != stageButterfly {
+			seen.NextStages[key] = destination
+		}
+	}
+	flow.Transitions[actionSeen] = seen
+	flow.AddStages(NewStage("larva"))
+	errs, _ = flow.Validate().(StructureErrors)
+	if errs.Has(TerminalTransition) || !errs.Has(UnreachableStage) {
+		t.Errorf("expected the larva to be unreachable from the egg, got %v", errs)
+	}
+}
+
+func TestSafeStageSerialization(t *testing.T) {
+	data, err := json.Marshal(buildMarkedFlow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := UnfinishedFlow[*Butterfly]{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	egg, cocoon := loaded.Stages[stageEgg], loaded.Stages[stageCocoon]
+	if label, _ := labelKey.Get(egg); !egg.Initial || label != "Egg" || !loaded.Stages[stageButterfly].Terminal {
+		t.Errorf("expected markers and metadata to survive a round trip, got %+v", loaded.Stages)
+	}
+	// durations come back as plain numbers
+	if _, OK := slaKey.Get(cocoon); OK || cocoon.Metadata["sla"] != float64(72*time.Hour) {
+		t.Errorf("expected the sla as a float64, got %#v", cocoon.Metadata["sla"])
+	}
+}
+
+const stageExposed = "exposed"
+
+// buildNestedFlow is the simple flow with everything but the cocoon sitting in an exposed stage
+// that owns the seen transition, so it only has to be wired up once
+func buildNestedFlow() UnfinishedFlow[*Butterfly] {
+	flow := NewFlow[*Butterfly]()
+
+	exposed := NewStage(stageExposed)
+	eggStage := NewStage(stageEgg, Initial(), ChildOf(stageExposed))
+	catStage := NewStage(stageCaterpillar, ChildOf(stageExposed))
+	cocoonStage := NewStage(stageCocoon)
+	butterflyStage := NewStage(stageButterfly, ChildOf(stageExposed))
+	mothStage := NewStage(stageMoth, ChildOf(stageExposed))
+	eatenStage := NewStage(stageEaten, Terminal())
+
+	blank, _ := NewValidationTable()
+	finished, _ := NewValidationTable("isFinishedMetamorphosing", true, "isBrown", false)
+	ageTran := NewTransition(actionAge)
+	ageTran.AddStage(&eggStage, blank, catStage)
+	ageTran.AddStage(&catStage, blank, cocoonStage)
+	ageTran.AddStage(&cocoonStage, AllOf(Flag("isFinishedMetamorphosing", true), Flag("isBrown", true)), mothStage, finished, butterflyStage)
+
+	seenTran := NewTransition(actionSeen)
+	seenTran.AddStage(&exposed, Flag("isGreen", false), eatenStage)
+	// moths blend in, so being seen doesn't get them eaten
+	seenTran.AddStage(&mothStage, Flag("isBrown", true), mothStage)
+
+	flow.AddStages(exposed, eggStage, catStage, cocoonStage, butterflyStage, mothStage, eatenStage)
+	flow.AddTransitions(ageTran, seenTran)
+	return flow
+}
+
+func TestSafeNestedStages(t *testing.T) {
+	unfinished := buildNestedFlow()
+	if err := unfinished.Validate(); err != nil {
+		t.Fatalf("expected the nested flow to be sound, got %v", err)
+	}
+	flow := unfinished.Finish()
+
+	exits, enters := []string{}, []string{}
+	flow.OnExit(stageExposed, func(event TransitionEvent[*Butterfly]) error {
+		exits = append(exits, event.Origin)
+		return nil
+	})
+	flow.OnEnter(stageExposed, func(event TransitionEvent[*Butterfly]) {
+		enters = append(enters, event.Destination)
+	})
+
+	// children take their parent's actions, but keep their own status
+	Nadia := Butterfly{color: "red", lifeStage: stageEgg}
+	available, _, _ := flow.AvailableActions(&Nadia)
+	if len(available) != 2 {
+		t.Errorf("expected an egg to be able to age and be seen, got %v", available)
+	}
+	if change, err := flow.TakeAction(&Nadia, actionAge); err != nil || change != stageCaterpillar {
+		t.Fatalf("expected %s, got %s, %v", stageCaterpillar, change, err)
+	}
+	if len(exits) != 0 {
+		t.Errorf("moving within the exposed stage shouldn't leave it, got %v", exits)
+	}
+	if change, err := flow.TakeAction(&Nadia, actionSeen); err != nil || change != stageEaten || Nadia.lifeStage != stageEaten {
+		t.Errorf("expected the inherited seen action to move her to %s, got %s, %v", stageEaten, change, err)
+	}
+	if fmt.Sprint(exits) != fmt.Sprint([]string{stageCaterpillar}) {
+		t.Errorf("expected the exposed stage to be left from %s, got %v", stageCaterpillar, exits)
+	}
+
+	// the cocoon isn't exposed
+	Nigel := Butterfly{color: "brown", lifeStage: stageCocoon, cocoonAge: 1}
+	if _, err := flow.TakeAction(&Nigel, actionSeen); !errors.Is(err, ErrActionNotAllowed) {
+		t.Errorf("expected %v for a cocoon, got %v", ErrActionNotAllowed, err)
+	}
+	if change, err := flow.TakeAction(&Nigel, actionAge); err != nil || change != stageMoth {
+		t.Fatalf("expected %s, got %s, %v", stageMoth, change, err)
+	}
+	if fmt.Sprint(enters) != fmt.Sprint([]string{stageMoth}) {
+		t.Errorf("expected the exposed stage to be entered at %s, got %v", stageMoth, enters)
+	}
+
+	// the moth's own branch is tried before its parent's
+	if change, err := flow.TakeAction(&Nigel, actionSeen); err != nil || change != stageMoth {
+		t.Errorf("expected the moth to stay put, got %s, %v", change, err)
+	}
+
+	// green bugs fall through every level and get told about all of them
+	Nora := Butterfly{color: "green", lifeStage: stageEgg}
+	_, err := flow.TakeAction(&Nora, actionSeen)
+	transErr := &TransitionError{}
+	if !errors.As(err, &transErr) || !errors.Is(err, ErrNoOutcome) || len(transErr.Candidates) != 1 || transErr.Candidates[0].Origin != stageExposed {
+		t.Errorf("expected the exposed stage's branch as the only candidate, got %v", err)
+	}
+
+	sources, _ := flow.Sources()
+	sinks, _ := flow.Sinks()
+	if fmt.Sprint(sources) != fmt.Sprint([]string{stageEgg}) || fmt.Sprint(sinks) != fmt.Sprint([]string{stageEaten}) {
+		t.Errorf("expected the graph to see inherited actions, got sources %v and sinks %v", sources, sinks)
+	}
+	if path, err := flow.ShortestPath(stageButterfly, stageEaten); err != nil || len(path) != 1 || path[0].From != stageButterfly {
+		t.Errorf("expected butterflies to be one step from being eaten, got %v, %v", path, err)
+	}
+}
+
+func TestSafeNestedStageValidation(t *testing.T) {
+	flow := buildNestedFlow()
+	flow.AddStages(NewStage("larva", ChildOf("grub")))
+	loop := NewStage("ouroboros", ChildOf("ouroboros"))
+	flow.AddStages(loop)
+
+	errs, _ := flow.Validate().(StructureErrors)
+	if !errs.Has(UnknownParent) || !errs.Has(ParentCycle) {
+		t.Errorf("expected problems with the parents, got %v", errs)
+	}
+}
+
+func TestSafeNestedTerminalStage(t *testing.T) {
+	// eaten bugs are still exposed, in a manner of speaking, but nothing happens to them after that
+	unfinished := buildNestedFlow()
+	unfinished.Stages[stageEaten] = NewStage(stageEaten, Terminal(), ChildOf(stageExposed))
+	errs, _ := unfinished.Validate().(StructureErrors)
+	found := false
+	for _, err := range errs {
+		found = found || (err.Kind == TerminalTransition && err.Stage == stageEaten && err.Transition == actionSeen)
+	}
+	if !found {
+		t.Errorf("expected the inherited seen action to be reported, got %v", errs)
+	}
+
+	flow := unfinished.Finish()
+	Olive := Butterfly{color: "red", lifeStage: stageEaten}
+	if _, err := flow.TakeAction(&Olive, actionSeen); !errors.Is(err, ErrActionNotAllowed) {
+		t.Errorf("expected %v for an eaten bug, got %v", ErrActionNotAllowed, err)
+	}
+	if available, _, _ := flow.AvailableActions(&Olive); len(available) != 0 {
+		t.Errorf("expected nothing to be available, got %v", available)
+	}
+	if sinks, _ := flow.Sinks(); fmt.Sprint(sinks) != fmt.Sprint([]string{stageEaten}) {
+		t.Errorf("expected eaten to stay a sink, got %v", sinks)
+	}
+}
@@ -1,13 +1,59 @@
 package flowchart
 
 import (
-	"errors"
 	"fmt"
+	"sort"
+	"time"
 )
 
 type Transition struct {
 	Name       string                      `json:"name"`
 	NextStages map[ValidationString]string `json:"nextStages"`
+	// branches are tried highest priority first; anything not listed here has priority 0
+	Priorities map[ValidationString]int `json:"priorities,omitempty"`
+	// when set, ties in priority go to the branch whose table checks the most tags
+	MostSpecificWins bool `json:"mostSpecificWins,omitempty"`
+	// only actors with at least one of these roles may take this action; anyone may if it's empty
+	Roles []string `json:"roles,omitempty"`
+	// when set, a Scheduler takes this action by itself once an asset has spent this long in an origin stage
+	Delay time.Duration `json:"delay,omitempty"`
+
+	order []ValidationString // declaration order of NextStages; the final tie breaker
+}
+
+// Outcome is one branch of a transition: leaving Origin, if the context meets When and Guard, go to Destination.
+// When is the canonical table that is actually evaluated, so it includes the origin stage flag.
+type Outcome struct {
+	Origin      string
+	When        ValidationTable
+	Guard       Guard // the zero Guard for branches added with a plain table
+	Destination string
+	Priority    int
+}
+
+func (o Outcome) matches(context ValidationTable) bool {
+	return context.meetsRequirementsOf(o.When) && o.Guard.Evaluate(context)
+}
+
+// key is the branch's key in NextStages: its table, then its guard if it has one
+func (o Outcome) key() ValidationString {
+	if o.Guard.IsZero() {
+		return o.When.toString()
+	}
+	return o.When.toString() + "&" + ValidationString(o.Guard.String())
+}
+
+// requiredFlags is every flag a context must have to match the branch, from its table and the
+// top level of its guard. It's not OK if the branch asks for a flag both ways and so can't match at all.
+func (o Outcome) requiredFlags() (ValidationTable, bool) {
+	required := o.When.MakeCopy()
+	OK := o.Guard.addRequiredFlags(&required)
+	return required, OK
+}
+
+// specificity is how many tags the branch looks at
+func (o Outcome) specificity() int {
+	return len(o.When.tags) + len(o.Guard.Tags())
 }
 
 func NewTransition(name string) Transition {
@@ -17,6 +63,43 @@ func NewTransition(name string) Transition {
 	}
 }
 
+// Branch is one way out of a stage: if the context meets When and If, go to To.
+// Either condition can be left as its zero value.
+type Branch struct {
+	When ValidationTable
+	If   Guard
+	To   Stage
+}
+
+// AddBranches adds the transition to originStage with the given ways out. Nothing is changed if
+// any branch is unusable.
+func (t *Transition) AddBranches(originStage *Stage, branches ...Branch) error {
+	if originStage == nil {
+		return fmt.Errorf("Unable to add stage with nil origin")
+	}
+	for _, branch := range branches {
+		if branch.To.Name == "" {
+			return fmt.Errorf("branch of '%s' from '%s' has no destination", t.Name, originStage.Name)
+		}
+		if err := branch.If.Err(); err != nil {
+			return fmt.Errorf("branch of '%s' from '%s' has a bad guard: %w", t.Name, originStage.Name, err)
+		}
+	}
+
+	if !contains(originStage.Transitions, t.Name) {
+		originStage.addTransition(t.Name)
+	}
+	for _, branch := range branches {
+		t.addBranch(originStage.Name, tableAndGuard{branch.When, branch.If}, branch.To.Name)
+	}
+	return nil
+}
+
+// AddStage adds the transition to originStage with pairs of conditions and destinations:
+// AddStage(&cocoon, brownTable, mothStage, greenTable, butterflyStage). Nothing is changed if
+// any pair is unusable.
+//
+// Deprecated: the pairs are only checked at runtime; use AddBranches instead.
 func (t *Transition) AddStage(originStage *Stage, nextSteps ...interface{}) error {
 	if originStage == nil {
 		return fmt.Errorf("Unable to add stage with nil origin")
@@ -24,33 +107,254 @@ func (t *Transition) AddStage(originStage *Stage, nextSteps ...interface{}) erro
 	if len(nextSteps)%2 != 0 {
 		return fmt.Errorf("Pairs of validation tables and destination stages are required for next steps")
 	}
-	originStage.addTransition(t.Name)
-	for ii := 0; ii < len(nextSteps); ii += 2 { // what if I pass in no next steps?
-		valTable, OK := nextSteps[ii].(ValidationTable)
+
+	// check every pair before touching anything
+	conditions, destinations := []Condition{}, []string{}
+	for ii := 0; ii < len(nextSteps); ii += 2 {
+		condition, OK := nextSteps[ii].(Condition)
 		if !OK {
-			return fmt.Errorf("Expected a valudation table, got %T", nextSteps[ii])
+			return fmt.Errorf("Expected a valudation table or guard, got %T", nextSteps[ii])
+		}
+		if _, guard := condition.condition(); guard.Err() != nil {
+			return fmt.Errorf("Bad guard for transition '%s': %w", t.Name, guard.Err())
 		}
 		nextStage, OK := nextSteps[ii+1].(Stage)
 		if !OK {
 			return fmt.Errorf("Expected a destination stage, got %T", nextSteps[ii+1])
 		}
-		originFlag := fmt.Sprintf(originStageFlag, originStage.Name)
-		valTable.AddFlag(originFlag, true)
-		t.NextStages[valTable.toString()] = nextStage.Name
+		conditions = append(conditions, condition)
+		destinations = append(destinations, nextStage.Name)
+	}
+
+	originStage.addTransition(t.Name)
+	for ii, condition := range conditions {
+		t.addBranch(originStage.Name, condition, destinations[ii])
 	}
 	return nil
 }
 
-func (t Transition) getOutcome(incomingTable ValidationTable) (string, error) {
-	for canonVals, status := range t.NextStages {
-		canonTable, err := canonVals.toTable()
+func (t *Transition) addBranch(originStage string, condition Condition, destination string) ValidationString {
+	key := branchKey(originStage, condition)
+	if _, exists := t.NextStages[key]; !exists {
+		t.order = append(t.order, key)
+	}
+	t.NextStages[key] = destination
+	return key
+}
+
+// SetPriority moves an existing branch ahead of (or behind) the branches declared around it.
+// Higher priorities are tried first.
+func (t *Transition) SetPriority(originStage Stage, condition Condition, priority int) error {
+	key := branchKey(originStage.Name, condition)
+	if _, OK := t.NextStages[key]; !OK {
+		return fmt.Errorf("transition '%s' has no branch from '%s' for %s", t.Name, originStage.Name, key)
+	}
+	if t.Priorities == nil {
+		t.Priorities = map[ValidationString]int{}
+	}
+	t.Priorities[key] = priority
+	return nil
+}
+
+// Outcomes lists every branch of the transition in the order TakeAction tries them:
+// by priority, then by specificity if MostSpecificWins is set, then in declaration order.
+func (t Transition) Outcomes() ([]Outcome, error) {
+	keys := t.declaredKeys()
+
+	outcomes := make([]Outcome, 0, len(keys))
+	for _, key := range keys {
+		table, guard, err := key.toCondition()
 		if err != nil {
-			return INVALID, err
+			return nil, err
 		}
-		matches := incomingTable.meetsRequirementsOf(canonTable)
-		if matches {
-			return status, nil
+		origin, err := branchOrigin(key)
+		if err != nil {
+			return nil, err
 		}
+		outcomes = append(outcomes, Outcome{
+			Origin:      origin,
+			When:        table,
+			Guard:       guard,
+			Destination: t.NextStages[key],
+			Priority:    t.Priorities[key],
+		})
+	}
+
+	sort.SliceStable(outcomes, func(i, j int) bool {
+		if outcomes[i].Priority != outcomes[j].Priority {
+			return outcomes[i].Priority > outcomes[j].Priority
+		}
+		if t.MostSpecificWins {
+			return outcomes[i].specificity() > outcomes[j].specificity()
+		}
+		return false
+	})
+	return outcomes, nil
+}
+
+// declaredKeys lists the keys of NextStages in the order they were added
+func (t Transition) declaredKeys() []ValidationString {
+	keys := []ValidationString{}
+	seen := map[ValidationString]bool{}
+	for _, key := range t.order {
+		if _, OK := t.NextStages[key]; OK && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	// branches set directly on NextStages have no declaration order, so fall back to sorting them
+	for _, key := range sortedKeys(t.NextStages) {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Overlaps finds pairs of branches leaving the same stage for different destinations that could both
+// match the same context, where nothing but declaration order decides which one wins. Pairs with too
+// many combinations of guard tags to check aren't included; see UnfinishedFlow.Overlaps.
+func (t Transition) Overlaps() ([][2]Outcome, error) {
+	overlaps, _, err := t.overlaps()
+	return overlaps, err
+}
+
+// overlaps is Overlaps, plus the pairs it couldn't settle either way
+func (t Transition) overlaps() (overlaps [][2]Outcome, unproven [][2]Outcome, err error) {
+	outcomes, err := t.Outcomes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overlaps, unproven = [][2]Outcome{}, [][2]Outcome{}
+	for ii := 0; ii < len(outcomes); ii++ {
+		for jj := ii + 1; jj < len(outcomes); jj++ {
+			first, second := outcomes[ii], outcomes[jj]
+			switch {
+			case first.Origin != second.Origin, first.Destination == second.Destination:
+				continue
+			case first.Priority != second.Priority:
+				continue
+			case t.MostSpecificWins && first.specificity() != second.specificity():
+				continue
+			}
+			overlap, settled := couldBothMatch(first, second)
+			switch {
+			case !settled:
+				unproven = append(unproven, [2]Outcome{first, second})
+			case overlap:
+				overlaps = append(overlaps, [2]Outcome{first, second})
+			}
+		}
+	}
+	return overlaps, unproven, nil
+}
+
+// outcomesFromLevels lists the branches leaving each of the origins in turn, then any branches with no
+// origin at all. Every key is only parsed once.
+func (t Transition) outcomesFromLevels(origins []string) ([]Outcome, error) {
+	outcomes, err := t.Outcomes()
+	if err != nil {
+		return nil, err
+	}
+	candidates := []Outcome{}
+	for _, origin := range append(append([]string{}, origins...), "") {
+		for _, outcome := range outcomes {
+			if outcome.Origin == origin {
+				candidates = append(candidates, outcome)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// maxMatchCombinations caps how many contexts couldBothMatch will try
+const maxMatchCombinations = 100000
+
+// couldBothMatch reports whether some context meets both branches. Tables alone are compared directly;
+// once guards are involved, flags either branch requires are fixed, every other flag is tried missing,
+// true and false, and every compared value is tried missing and at a sample from each range its literals
+// split it into. If that's too many combinations, it isn't settled.
+func couldBothMatch(first, second Outcome) (overlap bool, settled bool) {
+	required, firstOK := first.requiredFlags()
+	otherRequired, secondOK := second.requiredFlags()
+	if !firstOK || !secondOK || !required.compatibleWith(otherRequired) {
+		return false, true
+	}
+	if first.Guard.IsZero() && second.Guard.IsZero() {
+		return true, true
+	}
+	required = required.Merge(otherRequired)
+
+	// each dimension is one tag, and the ways it can appear in a context
+	dimensions := [][]func(*ValidationTable){}
+	flags := []string{}
+	for _, tags := range [][]string{first.When.tags, second.When.tags, first.Guard.flagTags(), second.Guard.flagTags()} {
+		for _, tag := range tags {
+			if contains(flags, tag) {
+				continue
+			}
+			flags = append(flags, tag)
+			tag := tag
+			if flag, OK := required.Get(tag); OK {
+				dimensions = append(dimensions, []func(*ValidationTable){
+					func(vt *ValidationTable) { vt.AddFlag(tag, flag) },
+				})
+				continue
+			}
+			dimensions = append(dimensions, []func(*ValidationTable){
+				func(*ValidationTable) {},
+				func(vt *ValidationTable) { vt.AddFlag(tag, true) },
+				func(vt *ValidationTable) { vt.AddFlag(tag, false) },
+			})
+		}
+	}
+	literals := first.Guard.valueLiterals()
+	for tag, values := range second.Guard.valueLiterals() {
+		literals[tag] = append(literals[tag], values...)
+	}
+	for _, tag := range sortedKeys(literals) {
+		tag := tag
+		options := []func(*ValidationTable){func(*ValidationTable) {}}
+		for _, sample := range sampleValues(literals[tag]) {
+			sample := sample
+			options = append(options, func(vt *ValidationTable) { vt.AddValue(tag, sample) })
+		}
+		dimensions = append(dimensions, options)
+	}
+
+	combinations := 1
+	for _, options := range dimensions {
+		combinations *= len(options)
+		if combinations > maxMatchCombinations {
+			return false, false
+		}
+	}
+	for combination := 0; combination < combinations; combination++ {
+		context := ValidationTableFrom(nil)
+		state := combination
+		for _, options := range dimensions {
+			options[state%len(options)](&context)
+			state /= len(options)
+		}
+		if first.matches(context) && second.matches(context) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// branchKey builds the canonical key for a branch leaving originStage, without touching the caller's table.
+// Guards are appended to the table after an '&'. Branches with no origin, which can only come from
+// NextStages being set by hand, get no origin flag and so apply from any stage that allows the action.
+func branchKey(originStage string, condition Condition) ValidationString {
+	valTable, guard := condition.condition()
+	canon := valTable.MakeCopy()
+	if originStage != "" {
+		canon.AddFlag(fmt.Sprintf(originStageFlag, originStage), true)
+	}
+	if guard.IsZero() {
+		return canon.toString()
 	}
-	return INVALID, errors.New("no outcome found given current validations")
+	return canon.toString() + "&" + ValidationString(guard.String())
 }
@@ -0,0 +1,125 @@
+package flowchart
+
+import (
+	"testing"
+)
+
+func TestSafeTransitionOutcomeOrder(t *testing.T) {
+	cocoonStage := NewStage(stageCocoon)
+	blankTable, _ := NewValidationTable()
+	mothValidator, _ := NewValidationTable("isBrown", true)
+
+	// branches are tried the way TakeAction tries them
+	preview := func(tran Transition) string {
+		unfinished := NewFlow[*Butterfly]()
+		unfinished.AddStages(cocoonStage, NewStage(stageButterfly), NewStage(stageMoth))
+		unfinished.AddTransitions(tran)
+		destination, _, err := unfinished.Finish().PreviewAction(&Butterfly{color: "brown", lifeStage: stageCocoon}, actionEmerge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return destination
+	}
+
+	// both branches match a brown bug, so the first one declared wins every time
+	emergeTran := NewTransition(actionEmerge)
+	if err := emergeTran.AddStage(&cocoonStage, blankTable, NewStage(stageButterfly), mothValidator, NewStage(stageMoth)); err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < 50; ii++ {
+		if destination := preview(emergeTran); destination != stageButterfly {
+			t.Fatalf("expected declaration order to pick %s, got %s", stageButterfly, destination)
+		}
+	}
+
+	overlaps, err := emergeTran.Overlaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlaps) != 1 {
+		t.Errorf("expected one ambiguous overlap, got %v", overlaps)
+	}
+
+	// the more specific branch wins when asked to
+	specificTran := emergeTran
+	specificTran.MostSpecificWins = true
+	if destination := preview(specificTran); destination != stageMoth {
+		t.Errorf("expected most specific branch to pick %s, got %s", stageMoth, destination)
+	}
+	if overlaps, _ := specificTran.Overlaps(); len(overlaps) != 0 {
+		t.Errorf("specificity should resolve the overlap, got %v", overlaps)
+	}
+
+	// an explicit priority beats declaration order
+	if err := emergeTran.SetPriority(cocoonStage, mothValidator, 1); err != nil {
+		t.Fatal(err)
+	}
+	if destination := preview(emergeTran); destination != stageMoth {
+		t.Errorf("expected prioritized branch to pick %s, got %s", stageMoth, destination)
+	}
+	if overlaps, _ := emergeTran.Overlaps(); len(overlaps) != 0 {
+		t.Errorf("priority should resolve the overlap, got %v", overlaps)
+	}
+
+	if err := emergeTran.SetPriority(NewStage(stageEgg), mothValidator, 1); err == nil {
+		t.Errorf("expected an error prioritizing a branch that doesn't exist")
+	}
+}
+
+func TestSafeTransitionAddBranches(t *testing.T) {
+	brown := ValidationTableFrom(map[string]bool{"isBrown": true})
+	notBrown := ValidationTableFrom(map[string]bool{"isBrown": false})
+
+	oldCocoon, newCocoon := NewStage(stageCocoon), NewStage(stageCocoon)
+	oldTran, newTran := NewTransition(actionEmerge), NewTransition(actionEmerge)
+	if err := oldTran.AddStage(&oldCocoon, notBrown, NewStage(stageButterfly), brown, NewStage(stageMoth), Flag("isGrey", true), NewStage(stageMoth)); err != nil {
+		t.Fatal(err)
+	}
+	err := newTran.AddBranches(&newCocoon,
+		Branch{When: notBrown, To: NewStage(stageButterfly)},
+		Branch{When: brown, To: NewStage(stageMoth)},
+		Branch{If: Flag("isGrey", true), To: NewStage(stageMoth)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOutcomes, _ := oldTran.Outcomes()
+	newOutcomes, _ := newTran.Outcomes()
+	if len(newOutcomes) != 3 || len(oldOutcomes) != len(newOutcomes) {
+		t.Fatalf("expected the same three branches, got %v and %v", oldOutcomes, newOutcomes)
+	}
+	for ii := range oldOutcomes {
+		if oldOutcomes[ii].When.toString() != newOutcomes[ii].When.toString() || oldOutcomes[ii].Guard.String() != newOutcomes[ii].Guard.String() {
+			t.Errorf("branch %d differs: %v and %v", ii, oldOutcomes[ii], newOutcomes[ii])
+		}
+	}
+	if len(newCocoon.Transitions) != 1 || newCocoon.Transitions[0] != actionEmerge {
+		t.Errorf("expected the cocoon to list %s once, got %v", actionEmerge, newCocoon.Transitions)
+	}
+
+	// adding more branches later doesn't list the transition twice
+	newTran.AddBranches(&newCocoon, Branch{To: NewStage(stageCocoon)})
+	if len(newCocoon.Transitions) != 1 {
+		t.Errorf("expected the cocoon to list %s once, got %v", actionEmerge, newCocoon.Transitions)
+	}
+}
+
+func TestSafeTransitionAddIsAtomic(t *testing.T) {
+	brown := ValidationTableFrom(map[string]bool{"isBrown": true})
+	cocoon := NewStage(stageCocoon)
+	tran := NewTransition(actionEmerge)
+
+	// the bad pair comes last, so nothing before it should stick either
+	err := tran.AddStage(&cocoon, brown, NewStage(stageMoth), brown, "butterfly")
+	if err == nil || len(cocoon.Transitions) != 0 || len(tran.NextStages) != 0 {
+		t.Errorf("expected a failed AddStage to change nothing, got %v, %v, %v", err, cocoon.Transitions, tran.NextStages)
+	}
+
+	err = tran.AddBranches(&cocoon, Branch{When: brown, To: NewStage(stageMoth)}, Branch{When: brown})
+	if err == nil || len(cocoon.Transitions) != 0 || len(tran.NextStages) != 0 {
+		t.Errorf("expected a failed AddBranches to change nothing, got %v, %v, %v", err, cocoon.Transitions, tran.NextStages)
+	}
+	if err := tran.AddBranches(nil); err == nil {
+		t.Errorf("expected an error for a nil origin")
+	}
+}
@@ -0,0 +1,410 @@
+package flowchart
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedFlowable is Flowable for assets whose stages and actions are their own string types, so a
+// typo like "cocon" is a compile error instead of a TakeAction failure.
+type TypedFlowable[S ~string, A ~string] interface {
+	GetStatus() (S, error)
+	SetStatus(newStatus S, action A) error
+	GetContext() (ValidationTable, error)
+}
+
+// TypedFlowableCtx is FlowableCtx for typed assets. TypedFlow passes its context along to assets
+// that implement it, just as Flow does for FlowableCtx.
+type TypedFlowableCtx[S ~string, A ~string] interface {
+	GetStatusCtx(ctx context.Context) (S, error)
+	SetStatusCtx(ctx context.Context, newStatus S, action A) error
+	GetContextCtx(ctx context.Context) (ValidationTable, error)
+}
+
+// TypedVersioned is Versioned for typed assets. Typed assets that implement either one get the same
+// compare-and-set writes as Versioned assets in a plain Flow.
+type TypedVersioned[S ~string, A ~string] interface {
+	GetVersion(ctx context.Context) (uint64, error)
+	CompareAndSetStatus(ctx context.Context, version uint64, newStatus S, action A) error
+}
+
+// TypedFlow is a finished flow that takes and returns S and A instead of plain strings. Failures
+// come back as the zero S along with the error, never INVALID.
+//
+//	type Stage string
+//	type Action string
+//	flow, err := NewTypedFlow[*Bug, Stage, Action](stages, transitions)
+//	stage, err := flow.TakeAction(bug, ActionAge)
+//
+// Stages and transitions are still built by name, e.g. NewStage(string(StageEgg)).
+type TypedFlow[Asset TypedFlowable[S, A], S ~string, A ~string] struct {
+	flow Flow[typedWrapper[Asset, S, A]]
+}
+
+// NewTypedFlow builds and validates a typed flow, like FinishValidated
+func NewTypedFlow[Asset TypedFlowable[S, A], S ~string, A ~string](stages []Stage, transitions []Transition, start ...S) (TypedFlow[Asset, S, A], error) {
+	unfinished := NewFlow[typedWrapper[Asset, S, A]]()
+	unfinished.AddStages(stages...)
+	unfinished.AddTransitions(transitions...)
+	flow, err := unfinished.FinishValidated(toStrings(start)...)
+	if err != nil {
+		return TypedFlow[Asset, S, A]{}, err
+	}
+	return TypedFlow[Asset, S, A]{flow: flow}, nil
+}
+
+func (f TypedFlow[Asset, S, A]) TakeAction(asset Asset, action A) (S, error) {
+	return f.TakeActionAs(context.Background(), Actor{}, asset, action)
+}
+
+func (f TypedFlow[Asset, S, A]) TakeActionContext(ctx context.Context, asset Asset, action A) (S, error) {
+	return f.TakeActionAs(ctx, Actor{}, asset, action)
+}
+
+func (f TypedFlow[Asset, S, A]) TakeActionAs(ctx context.Context, actor Actor, asset Asset, action A) (S, error) {
+	var none S
+	if !isPointer(asset) {
+		return none, fmt.Errorf("%w in TakeAction()", ErrNotPointer)
+	}
+	destination, err := f.flow.TakeActionAs(ctx, actor, wrapTyped[Asset, S, A](asset), string(action))
+	if destination == INVALID {
+		return none, err
+	}
+	return S(destination), err
+}
+
+// PreviewAction is Flow.PreviewAction with typed stages and actions
+func (f TypedFlow[Asset, S, A]) PreviewAction(asset Asset, action A) (S, ValidationTable, error) {
+	var none S
+	if !isPointer(asset) {
+		return none, ValidationTable{}, fmt.Errorf("%w in PreviewAction()", ErrNotPointer)
+	}
+	destination, table, err := f.flow.PreviewAction(wrapTyped[Asset, S, A](asset), string(action))
+	if err != nil {
+		return none, table, err
+	}
+	return S(destination), table, nil
+}
+
+// TypedActionOption is ActionOption with typed stages and actions; Destination is the zero S when blocked
+type TypedActionOption[S ~string, A ~string] struct {
+	Action      A
+	Destination S
+	Blocked     error
+}
+
+// AvailableActions is Flow.AvailableActions with typed stages and actions
+func (f TypedFlow[Asset, S, A]) AvailableActions(asset Asset) (available []TypedActionOption[S, A], blocked []TypedActionOption[S, A], err error) {
+	return f.AvailableActionsAs(Actor{}, asset)
+}
+
+func (f TypedFlow[Asset, S, A]) InitialStages() []S {
+	initial := []S{}
+	for _, stage := range f.flow.InitialStages() {
+		initial = append(initial, S(stage))
+	}
+	return initial
+}
+
+func (f TypedFlow[Asset, S, A]) IsTerminal(stage S) bool {
+	return f.flow.IsTerminal(string(stage))
+}
+
+// AvailableActionsAs is AvailableActions for a particular actor
+func (f TypedFlow[Asset, S, A]) AvailableActionsAs(actor Actor, asset Asset) (available []TypedActionOption[S, A], blocked []TypedActionOption[S, A], err error) {
+	if !isPointer(asset) {
+		return nil, nil, fmt.Errorf("%w in AvailableActions()", ErrNotPointer)
+	}
+	untypedAvailable, untypedBlocked, err := f.flow.AvailableActionsAs(actor, wrapTyped[Asset, S, A](asset))
+	if err != nil {
+		return nil, nil, err
+	}
+	available, blocked = []TypedActionOption[S, A]{}, []TypedActionOption[S, A]{}
+	for _, option := range untypedAvailable {
+		available = append(available, TypedActionOption[S, A]{Action: A(option.Action), Destination: S(option.Destination)})
+	}
+	for _, option := range untypedBlocked {
+		blocked = append(blocked, TypedActionOption[S, A]{Action: A(option.Action), Blocked: option.Blocked})
+	}
+	return available, blocked, nil
+}
+
+// ExplainAction is Flow.ExplainAction for a typed asset; branches are described with plain strings
+func (f TypedFlow[Asset, S, A]) ExplainAction(asset Asset, action A) ([]BranchExplanation, error) {
+	return f.ExplainActionAs(Actor{}, asset, action)
+}
+
+// ExplainActionAs is Flow.ExplainActionAs for a typed asset
+func (f TypedFlow[Asset, S, A]) ExplainActionAs(actor Actor, asset Asset, action A) ([]BranchExplanation, error) {
+	if !isPointer(asset) {
+		return nil, fmt.Errorf("%w in ExplainAction()", ErrNotPointer)
+	}
+	return f.flow.ExplainActionAs(actor, wrapTyped[Asset, S, A](asset), string(action))
+}
+
+// SetHistoryStore is Flow.SetHistoryStore; entries are recorded with plain string stages and actions
+func (f *TypedFlow[Asset, S, A]) SetHistoryStore(store HistoryStore) {
+	f.flow.SetHistoryStore(store)
+}
+
+// History is Flow.History for a typed asset
+func (f TypedFlow[Asset, S, A]) History(ctx context.Context, asset Asset) ([]HistoryEntry, error) {
+	return f.flow.History(ctx, wrapTyped[Asset, S, A](asset))
+}
+
+// SetAuthorizer is Flow.SetAuthorizer; the authorizer is told the action and origin as plain strings
+func (f *TypedFlow[Asset, S, A]) SetAuthorizer(authorizer Authorizer) {
+	f.flow.SetAuthorizer(authorizer)
+}
+
+// SetLocker is Flow.SetLocker
+func (f *TypedFlow[Asset, S, A]) SetLocker(locker Locker) {
+	f.flow.SetLocker(locker)
+}
+
+// SetConflictRetries is Flow.SetConflictRetries, for assets that implement TypedVersioned or Versioned
+func (f *TypedFlow[Asset, S, A]) SetConflictRetries(retries int) {
+	f.flow.SetConflictRetries(retries)
+}
+
+// TypedTransitionEvent is TransitionEvent with the typed asset, stages and action
+type TypedTransitionEvent[Asset TypedFlowable[S, A], S ~string, A ~string] struct {
+	Context     context.Context
+	Actor       Actor
+	Asset       Asset
+	Action      A
+	Origin      S
+	Destination S
+}
+
+// TypedBeforeHook is BeforeHook for a TypedFlow; returning an error vetoes the transition
+type TypedBeforeHook[Asset TypedFlowable[S, A], S ~string, A ~string] func(event TypedTransitionEvent[Asset, S, A]) error
+
+// TypedAfterHook is AfterHook for a TypedFlow
+type TypedAfterHook[Asset TypedFlowable[S, A], S ~string, A ~string] func(event TypedTransitionEvent[Asset, S, A])
+
+func typedEvent[Asset TypedFlowable[S, A], S ~string, A ~string](event TransitionEvent[typedWrapper[Asset, S, A]]) TypedTransitionEvent[Asset, S, A] {
+	return TypedTransitionEvent[Asset, S, A]{
+		Context:     event.Context,
+		Actor:       event.Actor,
+		Asset:       event.Asset.unwrap(),
+		Action:      A(event.Action),
+		Origin:      S(event.Origin),
+		Destination: S(event.Destination),
+	}
+}
+
+func (hook TypedBeforeHook[Asset, S, A]) untyped() BeforeHook[typedWrapper[Asset, S, A]] {
+	return func(event TransitionEvent[typedWrapper[Asset, S, A]]) error {
+		return hook(typedEvent(event))
+	}
+}
+
+func (hook TypedAfterHook[Asset, S, A]) untyped() AfterHook[typedWrapper[Asset, S, A]] {
+	return func(event TransitionEvent[typedWrapper[Asset, S, A]]) {
+		hook(typedEvent(event))
+	}
+}
+
+// BeforeTransition is Flow.BeforeTransition
+func (f *TypedFlow[Asset, S, A]) BeforeTransition(hook TypedBeforeHook[Asset, S, A]) {
+	f.flow.BeforeTransition(hook.untyped())
+}
+
+// AfterTransition is Flow.AfterTransition
+func (f *TypedFlow[Asset, S, A]) AfterTransition(hook TypedAfterHook[Asset, S, A]) {
+	f.flow.AfterTransition(hook.untyped())
+}
+
+// BeforeAction is Flow.BeforeAction
+func (f *TypedFlow[Asset, S, A]) BeforeAction(action A, hook TypedBeforeHook[Asset, S, A]) {
+	f.flow.BeforeAction(string(action), hook.untyped())
+}
+
+// AfterAction is Flow.AfterAction
+func (f *TypedFlow[Asset, S, A]) AfterAction(action A, hook TypedAfterHook[Asset, S, A]) {
+	f.flow.AfterAction(string(action), hook.untyped())
+}
+
+// OnExit is Flow.OnExit
+func (f *TypedFlow[Asset, S, A]) OnExit(stage S, hook TypedBeforeHook[Asset, S, A]) {
+	f.flow.OnExit(string(stage), hook.untyped())
+}
+
+// OnEnter is Flow.OnEnter
+func (f *TypedFlow[Asset, S, A]) OnEnter(stage S, hook TypedAfterHook[Asset, S, A]) {
+	f.flow.OnEnter(string(stage), hook.untyped())
+}
+
+// TypedPathStep is PathStep with typed stages and actions
+type TypedPathStep[S ~string, A ~string] struct {
+	From   S
+	Action A
+	To     S
+}
+
+// Reachable is Flow.Reachable with typed stages
+func (f TypedFlow[Asset, S, A]) Reachable(from S) ([]S, error) {
+	stages, err := f.flow.Reachable(string(from))
+	return fromStrings[S](stages), err
+}
+
+// ShortestPath is Flow.ShortestPath with typed stages and actions
+func (f TypedFlow[Asset, S, A]) ShortestPath(from, to S) ([]TypedPathStep[S, A], error) {
+	steps, err := f.flow.ShortestPath(string(from), string(to))
+	if err != nil {
+		return nil, err
+	}
+	typed := make([]TypedPathStep[S, A], 0, len(steps))
+	for _, step := range steps {
+		typed = append(typed, TypedPathStep[S, A]{From: S(step.From), Action: A(step.Action), To: S(step.To)})
+	}
+	return typed, nil
+}
+
+// StronglyConnectedComponents is Flow.StronglyConnectedComponents with typed stages
+func (f TypedFlow[Asset, S, A]) StronglyConnectedComponents() ([][]S, error) {
+	components, err := f.flow.StronglyConnectedComponents()
+	return fromStringGroups[S](components), err
+}
+
+// Cycles is Flow.Cycles with typed stages
+func (f TypedFlow[Asset, S, A]) Cycles() ([][]S, error) {
+	cycles, err := f.flow.Cycles()
+	return fromStringGroups[S](cycles), err
+}
+
+// Sinks is Flow.Sinks with typed stages
+func (f TypedFlow[Asset, S, A]) Sinks() ([]S, error) {
+	sinks, err := f.flow.Sinks()
+	return fromStrings[S](sinks), err
+}
+
+// Sources is Flow.Sources with typed stages
+func (f TypedFlow[Asset, S, A]) Sources() ([]S, error) {
+	sources, err := f.flow.Sources()
+	return fromStrings[S](sources), err
+}
+
+// typedWrapper is what the plain Flow underneath a TypedFlow drives. Every wrapper is a FlowableCtx,
+// and assets that are versioned get a wrapper that is Versioned as well.
+type typedWrapper[Asset TypedFlowable[S, A], S ~string, A ~string] interface {
+	FlowableCtx
+	Flowable
+	unwrap() Asset
+}
+
+func wrapTyped[Asset TypedFlowable[S, A], S ~string, A ~string](asset Asset) typedWrapper[Asset, S, A] {
+	wrapped := &typedAsset[Asset, S, A]{asset}
+	switch interface{}(asset).(type) {
+	case TypedVersioned[S, A], Versioned:
+		return &versionedTypedAsset[Asset, S, A]{wrapped}
+	}
+	return wrapped
+}
+
+// typedAsset lets a TypedFlowable be driven by a plain Flow
+type typedAsset[Asset TypedFlowable[S, A], S ~string, A ~string] struct {
+	asset Asset
+}
+
+func (t *typedAsset[Asset, S, A]) unwrap() Asset {
+	return t.asset
+}
+
+func (t *typedAsset[Asset, S, A]) GetStatus() (string, error) {
+	status, err := t.asset.GetStatus()
+	return string(status), err
+}
+
+func (t *typedAsset[Asset, S, A]) SetStatus(newStatus string, action string) error {
+	return t.asset.SetStatus(S(newStatus), A(action))
+}
+
+func (t *typedAsset[Asset, S, A]) GetContext() (ValidationTable, error) {
+	return t.asset.GetContext()
+}
+
+// the Ctx methods pass ctx along if the asset takes one, and otherwise fall back on the plain methods
+
+func (t *typedAsset[Asset, S, A]) GetStatusCtx(ctx context.Context) (string, error) {
+	if ctxAsset, OK := interface{}(t.asset).(TypedFlowableCtx[S, A]); OK {
+		status, err := ctxAsset.GetStatusCtx(ctx)
+		return string(status), err
+	}
+	return t.GetStatus()
+}
+
+func (t *typedAsset[Asset, S, A]) SetStatusCtx(ctx context.Context, newStatus string, action string) error {
+	if ctxAsset, OK := interface{}(t.asset).(TypedFlowableCtx[S, A]); OK {
+		return ctxAsset.SetStatusCtx(ctx, S(newStatus), A(action))
+	}
+	return t.SetStatus(newStatus, action)
+}
+
+func (t *typedAsset[Asset, S, A]) GetContextCtx(ctx context.Context) (ValidationTable, error) {
+	if ctxAsset, OK := interface{}(t.asset).(TypedFlowableCtx[S, A]); OK {
+		return ctxAsset.GetContextCtx(ctx)
+	}
+	return t.GetContext()
+}
+
+// FlowID keeps history under the asset's own ID rather than the wrapper's, which is new on every call
+func (t *typedAsset[Asset, S, A]) FlowID() string {
+	return assetID(t.asset)
+}
+
+// versionedTypedAsset is a typedAsset whose asset implements TypedVersioned or Versioned
+type versionedTypedAsset[Asset TypedFlowable[S, A], S ~string, A ~string] struct {
+	*typedAsset[Asset, S, A]
+}
+
+func (t *versionedTypedAsset[Asset, S, A]) GetVersion(ctx context.Context) (uint64, error) {
+	switch versioned := interface{}(t.asset).(type) {
+	case TypedVersioned[S, A]:
+		return versioned.GetVersion(ctx)
+	case Versioned:
+		return versioned.GetVersion(ctx)
+	}
+	return 0, nil
+}
+
+func (t *versionedTypedAsset[Asset, S, A]) CompareAndSetStatus(ctx context.Context, version uint64, newStatus string, action string) error {
+	switch versioned := interface{}(t.asset).(type) {
+	case TypedVersioned[S, A]:
+		return versioned.CompareAndSetStatus(ctx, version, S(newStatus), A(action))
+	case Versioned:
+		return versioned.CompareAndSetStatus(ctx, version, newStatus, action)
+	}
+	return t.SetStatusCtx(ctx, newStatus, action)
+}
+
+func toStrings[S ~string](names []S) []string {
+	strs := make([]string, 0, len(names))
+	for _, name := range names {
+		strs = append(strs, string(name))
+	}
+	return strs
+}
+
+func fromStrings[S ~string](strs []string) []S {
+	if strs == nil {
+		return nil
+	}
+	names := make([]S, 0, len(strs))
+	for _, str := range strs {
+		names = append(names, S(str))
+	}
+	return names
+}
+
+func fromStringGroups[S ~string](groups [][]string) [][]S {
+	if groups == nil {
+		return nil
+	}
+	typed := make([][]S, 0, len(groups))
+	for _, group := range groups {
+		typed = append(typed, fromStrings[S](group))
+	}
+	return typed
+}
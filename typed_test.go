@@ -0,0 +1,199 @@
+package flowchart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type BugStage string
+type BugAction string
+
+const (
+	bugEgg         BugStage  = stageEgg
+	bugCaterpillar BugStage  = stageCaterpillar
+	bugCocoon      BugStage  = stageCocoon
+	bugAge         BugAction = actionAge
+	bugSeen        BugAction = actionSeen
+)
+
+// TypedBug is a Butterfly that speaks in BugStage and BugAction
+type TypedBug struct {
+	Butterfly
+}
+
+func (bug *TypedBug) GetStatus() (BugStage, error) {
+	return BugStage(bug.lifeStage), nil
+}
+
+func (bug *TypedBug) SetStatus(status BugStage, action BugAction) error {
+	return bug.Butterfly.SetStatus(string(status), string(action))
+}
+
+// simpleStagesAndTransitions is the simple flow taken apart, for NewTypedFlow
+func simpleStagesAndTransitions() ([]Stage, []Transition) {
+	unfinished := buildSimpleFlow()
+	stages, transitions := []Stage{}, []Transition{}
+	for _, name := range sortedKeys(unfinished.Stages) {
+		stages = append(stages, unfinished.Stages[name])
+	}
+	for _, name := range sortedKeys(unfinished.Transitions) {
+		transitions = append(transitions, unfinished.Transitions[name])
+	}
+	// the simple flow never registers eaten, which validation won't stand for
+	stages = append(stages, NewStage(stageEaten))
+	return stages, transitions
+}
+
+func generateTypedFlow() (TypedFlow[*TypedBug, BugStage, BugAction], error) {
+	stages, transitions := simpleStagesAndTransitions()
+	return NewTypedFlow[*TypedBug, BugStage, BugAction](stages, transitions, bugEgg)
+}
+
+func TestSafeTypedFlow(t *testing.T) {
+	flow, err := generateTypedFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow.SetHistoryStore(NewMemoryHistory())
+
+	Tess := TypedBug{Butterfly{color: "green", lifeStage: stageEgg}}
+	stage, err := flow.TakeAction(&Tess, bugAge)
+	if err != nil || stage != bugCaterpillar {
+		t.Errorf("expected %s, got %s, %v", bugCaterpillar, stage, err)
+	}
+
+	// failures are the zero stage, not INVALID
+	stage, err = flow.TakeAction(&Tess, bugSeen)
+	if !errors.Is(err, ErrNoOutcome) || stage != "" {
+		t.Errorf("expected an empty stage and %v, got %q, %v", ErrNoOutcome, stage, err)
+	}
+
+	preview, _, err := flow.PreviewAction(&Tess, bugAge)
+	if err != nil || preview != bugCocoon {
+		t.Errorf("expected a preview of %s, got %s, %v", bugCocoon, preview, err)
+	}
+	available, _, err := flow.AvailableActions(&Tess)
+	if err != nil || len(available) != 1 || available[0].Action != bugAge || available[0].Destination != bugCocoon {
+		t.Errorf("expected only %s to be available, got %v, %v", bugAge, available, err)
+	}
+	if flow.IsTerminal(bugCocoon) || len(flow.InitialStages()) != 0 {
+		t.Errorf("nothing in the simple flow is marked")
+	}
+
+	// history is kept under the asset itself, not a new wrapper each time
+	entries, err := flow.History(context.Background(), &Tess)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("expected both attempts in history, got %v, %v", entries, err)
+	}
+
+	if _, err := NewTypedFlow[*TypedBug, BugStage, BugAction](nil, nil, bugEgg); err == nil {
+		t.Errorf("expected an error starting from a stage that isn't there")
+	}
+}
+
+type bugKey struct{}
+
+// StoredBug is a TypedBug kept somewhere that takes a context and a version for every write
+type StoredBug struct {
+	TypedBug
+	version  uint64
+	contexts []interface{}
+}
+
+func (bug *StoredBug) GetStatusCtx(ctx context.Context) (BugStage, error) {
+	return bug.GetStatus()
+}
+
+func (bug *StoredBug) SetStatusCtx(ctx context.Context, status BugStage, action BugAction) error {
+	return errors.New("stored bugs should only be moved with CompareAndSetStatus")
+}
+
+func (bug *StoredBug) GetContextCtx(ctx context.Context) (ValidationTable, error) {
+	bug.contexts = append(bug.contexts, ctx.Value(bugKey{}))
+	return bug.GetContext()
+}
+
+func (bug *StoredBug) GetVersion(_ context.Context) (uint64, error) {
+	return bug.version, nil
+}
+
+func (bug *StoredBug) CompareAndSetStatus(ctx context.Context, version uint64, status BugStage, action BugAction) error {
+	if version != bug.version {
+		return ErrConflict
+	}
+	bug.version++
+	bug.contexts = append(bug.contexts, ctx.Value(bugKey{}))
+	return bug.SetStatus(status, action)
+}
+
+func TestSafeTypedFlowPassesThrough(t *testing.T) {
+	stages, transitions := simpleStagesAndTransitions()
+	flow, err := NewTypedFlow[*StoredBug, BugStage, BugAction](stages, transitions, bugEgg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), bugKey{}, "request 7")
+
+	// a write sneaks in between reading the bug and moving it, once
+	sneaked := false
+	events := []string{}
+	flow.BeforeAction(bugAge, func(event TypedTransitionEvent[*StoredBug, BugStage, BugAction]) error {
+		if !sneaked {
+			sneaked = true
+			event.Asset.version++
+		}
+		return nil
+	})
+	flow.OnEnter(bugCaterpillar, func(event TypedTransitionEvent[*StoredBug, BugStage, BugAction]) {
+		events = append(events, fmt.Sprintf("%s: %s -> %s", event.Action, event.Origin, event.Destination))
+	})
+
+	Stella := StoredBug{TypedBug: TypedBug{Butterfly{color: "green", lifeStage: stageEgg}}}
+	if _, err := flow.TakeActionContext(ctx, &Stella, bugAge); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected the sneaked write to be caught, got %v", err)
+	}
+	flow.SetConflictRetries(1)
+	stage, err := flow.TakeActionContext(ctx, &Stella, bugAge)
+	if err != nil || stage != bugCaterpillar {
+		t.Fatalf("expected %s, got %s, %v", bugCaterpillar, stage, err)
+	}
+	if len(events) != 1 || events[0] != "age: egg -> caterpillar" {
+		t.Errorf("expected the typed enter hook to run once, got %q", events)
+	}
+	if len(Stella.contexts) == 0 {
+		t.Errorf("expected the bug to be asked for its context")
+	}
+	for _, value := range Stella.contexts {
+		if value != "request 7" {
+			t.Errorf("expected every call to get the caller's context, got %v", Stella.contexts)
+			break
+		}
+	}
+
+	// permissions and explanations go through the same checks as the plain flow
+	flow.SetAuthorizer(AuthorizerFunc(func(_ context.Context, actor Actor, action, _ string) error {
+		if action == string(bugSeen) && !actor.HasRole("bird") {
+			return errors.New("only birds see caterpillars")
+		}
+		return nil
+	}))
+	if _, err := flow.ExplainAction(&Stella, bugSeen); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+	explanations, err := flow.ExplainActionAs(Actor{ID: "robin", Roles: []string{"bird"}}, &Stella, bugSeen)
+	if err != nil || len(explanations) != 1 || explanations[0].Matches() {
+		t.Errorf("expected a green caterpillar to be missed, got %+v, %v", explanations, err)
+	}
+
+	// graph queries speak in stages and actions too
+	path, err := flow.ShortestPath(bugEgg, bugCocoon)
+	want := []TypedPathStep[BugStage, BugAction]{{bugEgg, bugAge, bugCaterpillar}, {bugCaterpillar, bugAge, bugCocoon}}
+	if err != nil || fmt.Sprint(path) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v, %v", want, path, err)
+	}
+	if reachable, err := flow.Reachable(bugCocoon); err != nil || len(reachable) == 0 {
+		t.Errorf("expected somewhere to go from the cocoon, got %v, %v", reachable, err)
+	}
+}
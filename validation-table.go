@@ -1,53 +1,270 @@
 package flowchart
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ValidationTable struct {
 	table map[string]bool
 	tags  []string
+
+	// typed values for comparison guards; only contexts need these, so they never appear in a ValidationString
+	values map[string]interface{}
 }
 
 type ValidationString string
 
+// NewValidationTable builds a table from tag, flag pairs: NewValidationTable("isGreen", true, "isBrown", false).
+// On any error it returns an empty table, ready to use like one from ValidationTableFrom(nil).
+//
+// Deprecated: the pairs are only checked at runtime; use ValidationTableFrom instead.
 func NewValidationTable(args ...interface{}) (ValidationTable, error) {
-	newTable := ValidationTable{
-		table: map[string]bool{},
-		tags:  []string{},
-	}
-
-	if len(args) == 0 {
-		return newTable, nil
-	}
 	if len(args)%2 != 0 {
-		return ValidationTable{}, errors.New("an even number of arguments is required for NewValidationTable")
+		return ValidationTableFrom(nil), errors.New("an even number of arguments is required for NewValidationTable")
 	}
 
+	flags := map[string]bool{}
 	for ii := 0; ii < len(args)-1; ii += 2 {
 		tag, tagOK := args[ii].(string)
 		if !tagOK {
-			return newTable, errors.New("didn't get type string as expected")
+			return ValidationTableFrom(nil), errors.New("didn't get type string as expected")
 		}
 
 		flag, flagOK := args[ii+1].(bool)
 		if !flagOK {
-			return newTable, errors.New("didn't get type boolean as expected")
+			return ValidationTableFrom(nil), errors.New("didn't get type boolean as expected")
 		}
-		newTable.AddFlag(tag, flag)
+		flags[tag] = flag
 	}
-	return newTable, nil
+	return ValidationTableFrom(flags), nil
+}
+
+// ValidationTableFrom builds a table with every tag in flags; a nil map gives an empty table
+func ValidationTableFrom(flags map[string]bool) ValidationTable {
+	newTable := ValidationTable{
+		table:  map[string]bool{},
+		tags:   []string{},
+		values: map[string]interface{}{},
+	}
+	for _, tag := range sortedKeys(flags) {
+		newTable.AddFlag(tag, flags[tag])
+	}
+	return newTable
 }
 
 func (vt ValidationTable) MakeCopy() ValidationTable {
 	str := vt.toString()
 	table, _ := str.toTable()
+	for tag, value := range vt.values {
+		table.values[tag] = value
+	}
 	return table
 }
 
+// AddValue stores a typed value for guards to compare against, e.g. Compare("cocoonAge", ">=", 3).
+// Values can be any integer or float type, a string or a time.Time; integers and floats are stored
+// as int64 and float64.
+func (vt *ValidationTable) AddValue(tag string, value interface{}) error {
+	normalized, err := normalizeValue(value)
+	if err != nil {
+		return fmt.Errorf("can't add value for tag '%s': %w", tag, err)
+	}
+	if vt.values == nil {
+		vt.values = map[string]interface{}{}
+	}
+	vt.values[tag] = normalized
+	return nil
+}
+
+// Value returns the typed value stored for a tag by AddValue
+func (vt ValidationTable) Value(tag string) (interface{}, bool) {
+	value, exists := vt.values[tag]
+	return value, exists
+}
+
+func normalizeValue(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case int:
+		return int64(typed), nil
+	case int8:
+		return int64(typed), nil
+	case int16:
+		return int64(typed), nil
+	case int32:
+		return int64(typed), nil
+	case int64:
+		return typed, nil
+	case uint:
+		return int64(typed), nil
+	case uint8:
+		return int64(typed), nil
+	case uint16:
+		return int64(typed), nil
+	case uint32:
+		return int64(typed), nil
+	case float32:
+		return normalizeValue(float64(typed))
+	case float64:
+		if math.IsNaN(typed) || math.IsInf(typed, 0) {
+			return nil, fmt.Errorf("value must be a finite number, got %v", typed)
+		}
+		return typed, nil
+	case string, time.Time:
+		return typed, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+// Get returns the flag stored for a tag, and whether there is one
+func (vt ValidationTable) Get(tag string) (bool, bool) {
+	flag, exists := vt.table[tag]
+	return flag, exists
+}
+
+// Tags lists every flag's tag, sorted
+func (vt ValidationTable) Tags() []string {
+	return append([]string{}, vt.tags...)
+}
+
+// Len is the number of flags in the table
+func (vt ValidationTable) Len() int {
+	return len(vt.tags)
+}
+
+// Range calls fn for every flag in tag order, stopping early if fn returns false
+func (vt ValidationTable) Range(fn func(tag string, flag bool) bool) {
+	for _, tag := range vt.Tags() {
+		if !fn(tag, vt.table[tag]) {
+			return
+		}
+	}
+}
+
+// Equal reports whether both tables hold the same flags and the same typed values
+func (vt ValidationTable) Equal(other ValidationTable) bool {
+	if vt.toString() != other.toString() || len(vt.values) != len(other.values) {
+		return false
+	}
+	for tag, value := range vt.values {
+		otherValue, exists := other.values[tag]
+		if !exists || !valuesEqual(value, otherValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual compares two typed values both ways round, since compareValues only reads a string as a
+// time when the time is on the left
+func valuesEqual(value, otherValue interface{}) bool {
+	if order, comparable := compareValues(value, otherValue); comparable {
+		return order == 0
+	}
+	order, comparable := compareValues(otherValue, value)
+	return comparable && order == 0
+}
+
+// Merge returns a new table with everything from both; where they disagree, other wins
+func (vt ValidationTable) Merge(other ValidationTable) ValidationTable {
+	merged := vt.MakeCopy()
+	for _, tag := range other.tags {
+		merged.AddFlag(tag, other.table[tag])
+	}
+	for tag, value := range other.values {
+		merged.values[tag] = value
+	}
+	return merged
+}
+
+// Without returns a new table with the given tags' flags and values left out
+func (vt ValidationTable) Without(tags ...string) ValidationTable {
+	trimmed := ValidationTableFrom(nil)
+	for _, tag := range vt.tags {
+		if !contains(tags, tag) {
+			trimmed.AddFlag(tag, vt.table[tag])
+		}
+	}
+	for tag, value := range vt.values {
+		if !contains(tags, tag) {
+			trimmed.values[tag] = value
+		}
+	}
+	return trimmed
+}
+
+// Matches reports whether this table, used as a context, meets every requirement of the canonical table
+func (vt ValidationTable) Matches(canon ValidationTable) bool {
+	return vt.meetsRequirementsOf(canon)
+}
+
+// String is the canonical "tag:true,tag2:false" form of the flags; typed values aren't included
+func (vt ValidationTable) String() string {
+	if len(vt.tags) == 0 {
+		return ""
+	}
+	return string(vt.toString())
+}
+
+// MarshalJSON writes the table as a single object: flags as booleans, typed values as numbers and
+// strings, and times as RFC 3339 strings. A tag with both a flag and a value only keeps its flag.
+func (vt ValidationTable) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{}
+	for tag, value := range vt.values {
+		out[tag] = value
+	}
+	for _, tag := range vt.tags {
+		out[tag] = vt.table[tag]
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON. Booleans become flags, whole numbers int64 values,
+// other numbers float64 values, and strings string values, so times come back as their RFC 3339 strings
+// (which comparison guards still read as times).
+func (vt *ValidationTable) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	raw := map[string]interface{}{}
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	table := ValidationTableFrom(nil)
+	for _, tag := range sortedKeys(raw) {
+		switch typed := raw[tag].(type) {
+		case bool:
+			table.AddFlag(tag, typed)
+		case json.Number:
+			if number, err := typed.Int64(); err == nil {
+				table.values[tag] = number
+				continue
+			}
+			number, err := typed.Float64()
+			if err != nil {
+				return fmt.Errorf("bad number for tag '%s': %w", tag, err)
+			}
+			table.values[tag] = number
+		case string:
+			table.values[tag] = typed
+		default:
+			return fmt.Errorf("unsupported JSON value for tag '%s': %T", tag, typed)
+		}
+	}
+	*vt = table
+	return nil
+}
+
+// toString writes the canonical form of the table: "tag:true,tag2:false" with tags sorted. Any '%', ',',
+// ':' or '&' in a tag is percent-encoded so the separators stay unambiguous.
 func (vt ValidationTable) toString() ValidationString {
 	if len(vt.tags) == 0 {
 		return ValidationString(" ")
@@ -55,40 +272,46 @@ func (vt ValidationTable) toString() ValidationString {
 
 	out := []string{}
 	for _, tag := range vt.tags {
-		out = append(out, fmt.Sprintf("%s:%t", tag, vt.table[tag]))
+		out = append(out, fmt.Sprintf("%s:%t", tagEscaper.Replace(tag), vt.table[tag]))
 	}
 
 	return ValidationString(strings.Join(out, ","))
 }
 
+var tagEscaper = strings.NewReplacer("%", "%25", ",", "%2C", ":", "%3A", "&", "%26")
+
+// unescapeTag reverses tagEscaper. A '%' that isn't followed by two hex digits is kept as it is,
+// since tables written before tags were escaped can contain them. One that is followed by two hex
+// digits is always decoded, so an old unescaped tag like "50%25" reads back as "50%".
+func unescapeTag(escaped string) string {
+	if !strings.Contains(escaped, "%") {
+		return escaped
+	}
+	var out strings.Builder
+	for ii := 0; ii < len(escaped); ii++ {
+		if escaped[ii] == '%' && ii+2 < len(escaped) {
+			if decoded, err := strconv.ParseUint(escaped[ii+1:ii+3], 16, 8); err == nil {
+				out.WriteByte(byte(decoded))
+				ii += 2
+				continue
+			}
+		}
+		out.WriteByte(escaped[ii])
+	}
+	return out.String()
+}
+
 func (vt *ValidationTable) AddFlag(tag string, flag bool) {
+	if vt.table == nil {
+		vt.table = map[string]bool{}
+	}
+
 	// add tag to values array, sorted
-	previousValue := ""
-Loop:
-	for index, listValue := range vt.tags {
-		// for scenarios with a non-zero array of tags
-		switch {
-		case listValue == tag: // our tag is already in the list; do not update array
-			break Loop
-		case previousValue == "" && tag < listValue: // special case; tag fits at the very front
-			vt.tags = append([]string{tag}, vt.tags...)
-			break Loop
-		case tag > listValue && index == len(vt.tags)-1: // special case where our tag fits at the very end
-			vt.tags = append(vt.tags, tag)
-		case previousValue < tag && tag > listValue: // tag fits between these two indices; moving on
-			previousValue = listValue
-		case tag < listValue: // we have passed our insertion point
-
-			vt.tags = append(vt.tags, "")
-			copy(vt.tags[index+1:], vt.tags[index:])
-			vt.tags[index] = tag
-			break Loop
-		}
-	}
-
-	// special case where the array is 0 length
-	if len(vt.tags) == 0 {
-		vt.tags = []string{tag}
+	index := sort.SearchStrings(vt.tags, tag)
+	if index == len(vt.tags) || vt.tags[index] != tag {
+		vt.tags = append(vt.tags, "")
+		copy(vt.tags[index+1:], vt.tags[index:])
+		vt.tags[index] = tag
 	}
 
 	// update/add flag to map
@@ -96,33 +319,89 @@ Loop:
 }
 
 func (vt ValidationTable) meetsRequirementsOf(incoming ValidationTable) bool {
+	return vt.diffAgainst(incoming).Empty()
+}
+
+// ValidationDiff lists everything keeping a context from meeting the requirements of a canonical table
+type ValidationDiff struct {
+	Missing    []string `json:"missing,omitempty"`    // tags the canonical table checks that the context doesn't have
+	Mismatched []string `json:"mismatched,omitempty"` // tags the context has, but with the other flag
+}
+
+func (d ValidationDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Mismatched) == 0
+}
+
+func (vt ValidationTable) diffAgainst(incoming ValidationTable) ValidationDiff {
+	diff := ValidationDiff{}
 	for _, tag := range incoming.tags {
 		ourFlag, exists := vt.table[tag]
 		if !exists {
-			return false
+			diff.Missing = append(diff.Missing, tag)
+			continue
 		}
 		if incoming.table[tag] != ourFlag {
+			diff.Mismatched = append(diff.Mismatched, tag)
+		}
+	}
+	return diff
+}
+
+// compatibleWith reports whether some context could meet the requirements of both tables,
+// i.e. no tag is required to be true by one and false by the other
+func (vt ValidationTable) compatibleWith(other ValidationTable) bool {
+	for _, tag := range vt.tags {
+		otherFlag, exists := other.table[tag]
+		if exists && otherFlag != vt.table[tag] {
 			return false
 		}
 	}
 	return true
 }
 
+// toCondition splits a branch key into its table and, if it has one, its guard
+func (valStr ValidationString) toCondition() (ValidationTable, Guard, error) {
+	tablePart, guardPart, hasGuard := strings.Cut(string(valStr), "&")
+	if !hasGuard {
+		table, err := valStr.toTable()
+		return table, Guard{}, err
+	}
+
+	table, tableErr := ValidationString(tablePart).toTable()
+	guard, guardErr := ParseGuard(guardPart)
+	if tableErr != nil || guardErr != nil {
+		// tables written before tags were escaped can have a bare '&' in a tag
+		if oldTable, err := valStr.toTable(); err == nil {
+			return oldTable, Guard{}, nil
+		}
+		if tableErr != nil {
+			return table, Guard{}, tableErr
+		}
+		return table, Guard{}, guardErr
+	}
+	return table, guard, nil
+}
+
+// toTable reads the form written by toString. It also reads tables written before tags were escaped,
+// as long as their tags don't contain a ',', or a '%' followed by two hex digits (see unescapeTag).
 func (valStr ValidationString) toTable() (ValidationTable, error) {
-	table, _ := NewValidationTable()
-	if string(valStr) == " " {
+	table := ValidationTableFrom(nil)
+	if string(valStr) == " " || string(valStr) == "" {
 		return table, nil
 	}
 	pairs := strings.Split(string(valStr), ",")
 
 	for _, pair := range pairs {
-		tokens := strings.Split(pair, ":")
-		tag := tokens[0]
-		flag, err := strconv.ParseBool(tokens[1])
+		// unescaped tags could contain ':', but the flag never does
+		separator := strings.LastIndex(pair, ":")
+		if separator < 0 {
+			return table, fmt.Errorf("malformed validation string %q: no flag for %q", valStr, pair)
+		}
+		flag, err := strconv.ParseBool(pair[separator+1:])
 		if err != nil {
-			return table, err
+			return table, fmt.Errorf("malformed validation string %q: %w", valStr, err)
 		}
-		table.AddFlag(tag, flag)
+		table.AddFlag(unescapeTag(pair[:separator]), flag)
 	}
 
 	return table, nil
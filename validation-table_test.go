@@ -1,7 +1,10 @@
 package flowchart
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestSafeValidationTableCreation(t *testing.T) {
@@ -61,6 +64,33 @@ func TestSafeValidationTableCreation(t *testing.T) {
 	}
 }
 
+func TestSafeValidationTableFrom(t *testing.T) {
+	table := ValidationTableFrom(map[string]bool{"isGreen": true, "isBrown": false})
+	old, _ := NewValidationTable("isBrown", false, "isGreen", true)
+	if !table.Equal(old) || table.toString() != old.toString() {
+		t.Errorf("expected %s to match %s", table, old)
+	}
+	if empty := ValidationTableFrom(nil); empty.Len() != 0 {
+		t.Errorf("expected an empty table, got %s", empty)
+	}
+	empty := ValidationTableFrom(nil)
+	empty.AddFlag("didn't panic", true)
+
+	// a bad pair anywhere gives back nothing, not the pairs before it
+	partial, err := NewValidationTable("isGreen", true, "isBrown", "no")
+	if err == nil || partial.Len() != 0 {
+		t.Errorf("expected an empty table and an error, got %s, %v", partial, err)
+	}
+
+	// ...and that table, like a zero one, is still fit to add to
+	for _, table := range []ValidationTable{partial, {}} {
+		table.AddFlag("isGreen", true)
+		if flag, OK := table.Get("isGreen"); !OK || !flag || table.Len() != 1 {
+			t.Errorf("expected the flag to be added, got %s", table)
+		}
+	}
+}
+
 func TestSafeValidationTableMeetRequirements(t *testing.T) {
 	// check if a larger table meetsRequirements for a smaller one
 	bigTable, _ := NewValidationTable("first", true, "second", true, "third", false, "fourth", false, "fifth", true)
@@ -94,3 +124,194 @@ func TestSafeValidationTableMeetRequirements(t *testing.T) {
 
 	}
 }
+
+func TestSafeValidationStringEscaping(t *testing.T) {
+	awkward, _ := NewValidationTable("region:eu", true, "a,b", false, "50%", true, "this&that", true, "", false)
+	valStr := awkward.toString()
+	copyTable, err := valStr.toTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copyTable.toString() != valStr || len(copyTable.tags) != 5 {
+		t.Errorf("escaped tags did not survive the round trip: %s became %s", valStr, copyTable.toString())
+	}
+	for _, tag := range awkward.tags {
+		if flag, OK := copyTable.table[tag]; !OK || flag != awkward.table[tag] {
+			t.Errorf("lost tag %q", tag)
+		}
+	}
+
+	// strings written before escaping still read back
+	oldStrings := map[ValidationString]string{
+		"isBrown:true,isGreen:false": "isBrown",
+		"region:eu:true":             "region:eu",
+		"50%off:true":                "50%off",
+		"this&that:true":             "this&that",
+	}
+	for oldStr, tag := range oldStrings {
+		table, _, err := oldStr.toCondition()
+		if err != nil {
+			t.Errorf("couldn't read %q: %v", oldStr, err)
+			continue
+		}
+		if !table.table[tag] {
+			t.Errorf("expected tag %q in %q, got %s", tag, oldStr, table.toString())
+		}
+	}
+	// ...except a '%' followed by two hex digits, which always reads as an escape
+	if table, _ := ValidationString("50%25:true").toTable(); fmt.Sprint(table.Tags()) != fmt.Sprint([]string{"50%"}) {
+		t.Errorf("expected an old %q to read back as %q, got %v", "50%25", "50%", table.Tags())
+	}
+
+	// bad strings are errors, not panics
+	for _, bad := range []ValidationString{"isBrown", "isBrown:maybe", "isBrown:true,", ","} {
+		if _, err := bad.toTable(); err == nil {
+			t.Errorf("expected an error reading %q", bad)
+		}
+	}
+}
+
+func FuzzValidationStringRoundTrip(f *testing.F) {
+	f.Add("isBrown", true, "isGreen", false)
+	f.Add("region:eu", true, "a,b", false)
+	f.Add("%3A", false, "&", true)
+	f.Add("", true, " ", false)
+	f.Fuzz(func(t *testing.T, firstTag string, firstFlag bool, secondTag string, secondFlag bool) {
+		table, err := NewValidationTable(firstTag, firstFlag, secondTag, secondFlag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valStr := table.toString()
+		copyTable, err := valStr.toTable()
+		if err != nil {
+			t.Fatalf("couldn't read back %q: %v", valStr, err)
+		}
+		if copyTable.toString() != valStr {
+			t.Fatalf("%q read back as %q", valStr, copyTable.toString())
+		}
+		if !copyTable.meetsRequirementsOf(table) || !table.meetsRequirementsOf(copyTable) {
+			t.Fatalf("%q read back as a different table", valStr)
+		}
+
+		// and the same through a branch key, which may carry a guard
+		key := branchKey(stageCocoon, AllOf(Flag(firstTag, firstFlag), DontCare(secondTag)))
+		if _, _, err := key.toCondition(); err != nil {
+			t.Fatalf("couldn't read back branch key %q: %v", key, err)
+		}
+	})
+}
+
+func FuzzValidationStringParse(f *testing.F) {
+	f.Add("isBrown:true,isGreen:false")
+	f.Add(" ")
+	f.Add("region:eu:true")
+	f.Add("a%2Cb:true&isBrown | !(isGreen)")
+	f.Add(":")
+	f.Fuzz(func(t *testing.T, text string) {
+		// anything goes, as long as it doesn't panic and what it reads writes back stably
+		table, err := ValidationString(text).toTable()
+		if err != nil {
+			return
+		}
+		again, err := table.toString().toTable()
+		if err != nil || again.toString() != table.toString() {
+			t.Fatalf("%q read back as %q, then %q (%v)", text, table.toString(), again.toString(), err)
+		}
+		ValidationString(text).toCondition()
+	})
+}
+
+func TestSafeValidationTableReadAPI(t *testing.T) {
+	table, _ := NewValidationTable("isGreen", false, "isBrown", true)
+	table.AddValue("cocoonAge", 3)
+
+	if flag, OK := table.Get("isBrown"); !OK || !flag {
+		t.Errorf("expected isBrown to be true")
+	}
+	if _, OK := table.Get("isGrey"); OK {
+		t.Errorf("did not expect isGrey to exist")
+	}
+	if table.Len() != 2 || table.String() != "isBrown:true,isGreen:false" {
+		t.Errorf("unexpected table %s with %d flags", table, table.Len())
+	}
+
+	// what comes out can't be used to change the table
+	tags := table.Tags()
+	tags[0] = "changed"
+	if table.Tags()[0] != "isBrown" {
+		t.Errorf("Tags should return a copy")
+	}
+
+	visited := []string{}
+	table.Range(func(tag string, flag bool) bool {
+		visited = append(visited, tag)
+		return false
+	})
+	if len(visited) != 1 || visited[0] != "isBrown" {
+		t.Errorf("Range should visit tags in order and stop early, got %v", visited)
+	}
+
+	merged := table.Merge(func() ValidationTable {
+		other, _ := NewValidationTable("isBrown", false, "isAdult", true)
+		return other
+	}())
+	if merged.String() != "isAdult:true,isBrown:false,isGreen:false" {
+		t.Errorf("unexpected merge %s", merged)
+	}
+	if flag, _ := table.Get("isBrown"); !flag {
+		t.Errorf("Merge should not change the original table")
+	}
+	if age, _ := merged.Value("cocoonAge"); age != int64(3) {
+		t.Errorf("Merge should keep typed values, got %v", age)
+	}
+
+	trimmed := merged.Without("isAdult", "cocoonAge")
+	if trimmed.String() != "isBrown:false,isGreen:false" {
+		t.Errorf("unexpected trimmed table %s", trimmed)
+	}
+	if _, OK := trimmed.Value("cocoonAge"); OK {
+		t.Errorf("Without should drop typed values too")
+	}
+
+	requirements, _ := NewValidationTable("isBrown", true)
+	if !table.Matches(requirements) || trimmed.Matches(requirements) {
+		t.Errorf("Matches should agree with meetsRequirementsOf")
+	}
+
+	if !table.Equal(table.MakeCopy()) || table.Equal(trimmed) {
+		t.Errorf("Equal should compare flags and values")
+	}
+	blank, _ := NewValidationTable()
+	if blank.String() != "" || !blank.Equal(ValidationTable{}) {
+		t.Errorf("an empty table should print as nothing and equal the zero table")
+	}
+}
+
+func TestSafeValidationTableJSON(t *testing.T) {
+	table, _ := NewValidationTable("isGreen", false, "isBrown", true)
+	table.AddValue("cocoonAge", 3)
+	table.AddValue("wingspan", 4.5)
+	table.AddValue("color", "grey")
+	table.AddValue("laidAt", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC))
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"cocoonAge":3,"color":"grey","isBrown":true,"isGreen":false,"laidAt":"2026-04-01T00:00:00Z","wingspan":4.5}`; string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+
+	loaded := ValidationTable{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	// the time comes back as a string, which is still equal to it from either side
+	if !loaded.Equal(table) || !table.Equal(loaded) {
+		t.Errorf("round trip changed the table: %s", loaded)
+	}
+
+	if err := json.Unmarshal([]byte(`{"spots":[1,2]}`), &loaded); err == nil {
+		t.Errorf("expected an error loading an array value")
+	}
+}